@@ -0,0 +1,163 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/shibukawa/configdir"
+)
+
+// Base name of the card back image in the cache directory; the extension
+// matches the image type.
+const cardBackName = "card-back"
+
+// Values of --fill-empty other than the path of an image file.
+const (
+	fillBlank = "blank"
+	fillBack  = "back"
+)
+
+// LoadCardBack downloads the card back image for --card-backs or
+// --fill-empty back into the cache.  If the download fails, a previously
+// cached card back is used.
+func (app *App) LoadCardBack() {
+	if app.err != nil || (!app.cardBacks && app.fillEmpty != fillBack) {
+		return
+	}
+	defer app.failed(stageImages)
+
+	var backPath string
+	if app.cacheReadOnly {
+		backPath, app.err = cachedCardBack(app.cache)
+	} else {
+		backPath, app.err = fetchCardBack(app.ctx, app.fetch, app.cache, app.cardBackURL, app.imageTimeout)
+	}
+	if app.err != nil {
+		return
+	}
+
+	back := &XMLCard{
+		Card:      "card back",
+		Name:      "card back",
+		ImagePath: backPath,
+		Override:  true,
+	}
+	if app.cardBacks {
+		app.render.Back = back
+	}
+	if app.fillEmpty == fillBack {
+		app.render.Filler = back
+	}
+}
+
+// fillerImage returns the card drawn in empty slots for --fill-empty with
+// the path of an image file.
+func fillerImage(path string) (*XMLCard, error) {
+	filler := &XMLCard{Card: "filler", Name: "filler", ImagePath: path, Override: true}
+	head, err := readFileHead(path)
+	if err != nil {
+		return nil, fmt.Errorf("--fill-empty: %v", err)
+	}
+	if (getImageOptions(head, *filler) == gofpdf.ImageOptions{}) {
+		return nil, fmt.Errorf("--fill-empty: %s is not a JPEG, PNG or GIF image", path)
+	}
+	return filler, nil
+}
+
+// fetchCardBack saves the image at url as the cached card back and returns
+// its full path, falling back to any earlier cached card back if the
+// download fails.
+func fetchCardBack(ctx context.Context, f *fetcher, cache *configdir.Config, url string, timeout time.Duration) (string, error) {
+	data, err := f.getBytes(ctx, url, timeout)
+	if err == nil {
+		return saveCardBack(cache, data)
+	}
+
+	cached := cachedCardBacks(cache)
+	if len(cached) == 0 {
+		return "", fmt.Errorf("failed fetching card back from %s: %v", url, err)
+	}
+	logWarn("failed fetching card back from %s: %v (using cached %s)", url, err, cached[0])
+	return cached[0], nil
+}
+
+// cachedCardBack returns the full path of the cached card back.
+func cachedCardBack(cache *configdir.Config) (string, error) {
+	cached := cachedCardBacks(cache)
+	if len(cached) == 0 {
+		return "", fmt.Errorf("no card back in the read-only cache")
+	}
+	return cached[0], nil
+}
+
+// cachedCardBacks returns the full paths of the cached card back images,
+// leaving out files still being written.
+func cachedCardBacks(cache *configdir.Config) []string {
+	var backs []string
+	matches, _ := filepath.Glob(filepath.Join(cache.Path, cardBackName+".*"))
+	for _, p := range matches {
+		if filepath.Ext(p) != ".tmp" {
+			backs = append(backs, p)
+		}
+	}
+	return backs
+}
+
+// saveCardBack writes a card back image to the cache, replacing any earlier
+// one, and returns its full path.  The image is replaced in one step, since
+// another run may be reading it, and only a card back of another image type
+// is removed.
+func saveCardBack(cache *configdir.Config, data []byte) (string, error) {
+	opts := getImageOptions(data, XMLCard{Card: "card back", ImagePath: cardBackName})
+	if (opts == gofpdf.ImageOptions{}) {
+		return "", fmt.Errorf("card back is not a JPEG, PNG or GIF image")
+	}
+
+	name := cardBackName + "." + strings.ToLower(opts.ImageType)
+	err := writeCacheFile(cache, name, data)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(cache.Path, name)
+	for _, p := range cachedCardBacks(cache) {
+		if p != path {
+			_ = os.Remove(p)
+		}
+	}
+	return path, nil
+}
+
+// renderBackPage adds a page with the card back behind each of the first n
+// slots of the preceding front page.  Columns are mirrored so that backs
+// line up with their fronts when printed double-sided and flipped on the long
+// edge, then shifted by opts.BackOffset.
+func renderBackPage(pdf gofpdf.Pdf, layout Layout, opts RenderOptions, n int) {
+	pdf.AddPage()
+
+	var slots []Rect
+	for i := 0; i < n && i < layout.CardsPerPage(); i++ {
+		row, col := i/layout.Cols, i%layout.Cols
+		x, y := layout.SlotPosition(row, layout.Cols-1-col)
+		slots = append(slots, Rect{
+			X: x + opts.BackOffset.X,
+			Y: y + opts.BackOffset.Y,
+			W: layout.CardWidth,
+			H: layout.CardHeight,
+		})
+	}
+	renderFrames(pdf, slots, layout.Border, opts.FrameColor)
+	for _, slot := range slots {
+		renderImage(pdf, opts.Back.ImagePath, slot, opts)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSaveCardBack(t *testing.T) {
+	cache, _, cleanup := newTestCache(t)
+	defer cleanup()
+
+	// Another run's write in progress is not a card back.
+	err := ioutil.WriteFile(filepath.Join(cache.Path, "card-back.png.123.tmp"), []byte("partial"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blue := color.NRGBA{B: 200, A: 255}
+	for _, back := range []struct{ format, name string }{
+		{"png", "card-back.png"},
+		{"png", "card-back.png"},
+		{"jpeg", "card-back.jpeg"},
+	} {
+		path, err := saveCardBack(cache, testImage(t, back.format, 5, 7, blue))
+		if err != nil {
+			t.Fatalf("saveCardBack: %v", err)
+		}
+		want := filepath.Join(cache.Path, back.name)
+		if path != want {
+			t.Errorf("card back saved as %s, want %s", path, want)
+		}
+		if got := cachedCardBacks(cache); !reflect.DeepEqual(got, []string{want}) {
+			t.Errorf("cached card backs are %v, want just %s", got, want)
+		}
+	}
+	if !cache.Exists("card-back.png.123.tmp") {
+		t.Error("another run's temporary file was removed")
+	}
+}
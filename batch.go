@@ -0,0 +1,137 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// batchDeck is one of the deck files given to the batch subcommand.
+type batchDeck struct {
+	input string
+	deck  []XMLCard
+	err   error
+}
+
+// parseBatchArgs returns the deck files given to the batch subcommand,
+// parsing any options among them so that options can also follow the
+// files.
+func parseBatchArgs(args []string) []string {
+	var inputs []string
+	for len(args) > 0 {
+		if args[0] == "--" {
+			return append(inputs, args[1:]...)
+		}
+		if len(args[0]) > 1 && args[0][0] == '-' {
+			// The command line uses flag.ExitOnError.
+			_ = flag.CommandLine.Parse(args)
+			args = flag.Args()
+			continue
+		}
+		inputs = append(inputs, args[0])
+		args = args[1:]
+	}
+	return inputs
+}
+
+// RunBatch writes each deck file in inputs to its own output in the
+// --output-dir directory.  The images of all the decks are fetched together
+// before any output is written.  A deck that fails doesn't stop the others;
+// app.err is set at the end if any did.
+func (app *App) RunBatch(inputs []string) {
+	if app.err != nil {
+		return
+	}
+
+	decks := make([]batchDeck, len(inputs))
+	var all []XMLCard
+	for i, input := range inputs {
+		app.inputFile, app.deck = input, nil
+		timeStage("parse", app.ParseInputFile)
+		decks[i] = batchDeck{input: input, deck: app.deck, err: app.err}
+		if app.err == nil {
+			all = append(all, app.deck...)
+		}
+		app.err = nil
+	}
+
+	var failed map[string]error
+	failed, app.err = app.fetchImages(all)
+	if app.err != nil {
+		return
+	}
+	app.deck = all
+	app.EvictCachedImages()
+	timeStage("card back", app.LoadCardBack)
+	if app.err != nil {
+		return
+	}
+
+	app.usedOutputs = make(map[string]bool)
+	var failures []string
+	for _, d := range decks {
+		if d.err == nil {
+			d.err = fetchErrors(d.deck, failed)
+		}
+		if d.err == nil {
+			d.err = app.writeBatchDeck(d)
+		}
+		if app.ctx.Err() != nil {
+			app.err = app.ctx.Err()
+			return
+		}
+		if d.err != nil {
+			logWarn("%s: %v", d.input, d.err)
+			failures = append(failures, d.input)
+		}
+	}
+
+	app.ReportMissingImages()
+	if app.err != nil {
+		return
+	}
+	countLog(len(decks)).info("wrote %d of %d decks", len(decks)-len(failures), len(decks))
+	if len(failures) > 0 {
+		app.err = fmt.Errorf("%d of %d decks failed: %s", len(failures), len(decks), strings.Join(failures, ", "))
+	}
+}
+
+// writeBatchDeck writes the output of one deck of a batch, printing its
+// file name if it succeeds.
+func (app *App) writeBatchDeck(d batchDeck) error {
+	app.inputFile, app.deck = d.input, d.deck
+	app.outputFile = app.autoOutputPath(app.outputDir)
+	app.usedOutputs[app.outputFile] = true
+	logInfo("writing %s to %s", d.input, app.outputFile)
+
+	timeStage("pdf", app.CreatePDF)
+	timeStage("png", app.CreatePNG)
+	timeStage("html", app.CreateHTML)
+	err := app.err
+	app.err = nil
+	if err == nil {
+		fmt.Println(app.outputFile)
+	}
+	return err
+}
+
+// fetchErrors returns an error for the images of deck that could not be
+// fetched, if any.
+func fetchErrors(deck []XMLCard, failed map[string]error) error {
+	mine := make(map[string]error)
+	for _, card := range deck {
+		if err, ok := failed[card.ImagePath]; ok {
+			mine[card.ImagePath] = err
+		}
+	}
+	if len(mine) == 0 {
+		return nil
+	}
+	return &AppError{Stage: stageImages, Err: imageErrors(mine)}
+}
@@ -0,0 +1,305 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shibukawa/configdir"
+)
+
+// Environment variable with the default for --cache-dir.
+const cacheDirEnv = "LOTRPROXYPDF_CACHE_DIR"
+
+// openCache returns the cache folder named for a game, either in the user
+// cache folder or, if dir is set, in dir.  The default game's cache is dir
+// itself.  A non-empty key selects a subdirectory of that folder.
+func openCache(dir string, name string, key string) *configdir.Config {
+	var cache *configdir.Config
+	if dir == "" {
+		cache = configdir.New(vendorName, name).QueryCacheFolder()
+	} else {
+		if name != appConfigName {
+			dir = filepath.Join(dir, name)
+		}
+		cache = &configdir.Config{Path: dir, Type: configdir.Cache}
+	}
+	if key != "" {
+		cache.Path = filepath.Join(cache.Path, sanitizeFileName(key))
+	}
+	return cache
+}
+
+// uncompressedName strips any .gz extension from a file name.
+func uncompressedName(name string) string {
+	return strings.TrimSuffix(name, ".gz")
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	if err == nil {
+		err = zw.Close()
+	}
+	return buf.Bytes(), err
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// writeCacheFile writes a file in the cache by way of a temporary file in
+// the same folder, so an interrupted write never leaves a truncated file
+// under the final name.
+func writeCacheFile(cache *configdir.Config, name string, data []byte) error {
+	path := filepath.Join(cache.Path, name)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = tmp.Chmod(0644)
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = renameOver(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// renameOver renames a file in place of another.  Windows refuses while
+// another run is reading the file it replaces, so there it tries again for
+// a moment.
+func renameOver(from, to string) error {
+	err := os.Rename(from, to)
+	for i := 0; err != nil && runtime.GOOS == "windows" && i < renameRetries; i++ {
+		time.Sleep(renameRetryDelay)
+		err = os.Rename(from, to)
+	}
+	return err
+}
+
+// EvictCachedImages removes the least recently used images from the cache
+// until the images folder fits --cache-max-size.  Images of the current deck
+// are never removed.  Use is tracked by modification time, which
+// imageCached updates.
+func (app *App) EvictCachedImages() {
+	if app.err != nil || app.cacheMaxSize == 0 || app.cacheReadOnly {
+		return
+	}
+
+	inUse := make(map[string]bool)
+	for _, card := range app.deck {
+		if !card.Override {
+			inUse[filepath.ToSlash(card.ImagePath)] = true
+		}
+	}
+
+	type cachedImage struct {
+		name string
+		size int64
+		used time.Time
+	}
+	var images []cachedImage
+	var total int64
+	for _, name := range cachedImages(app.cache) {
+		stat, err := os.Stat(filepath.Join(app.cache.Path, cacheImageFolder, name))
+		if err != nil {
+			continue
+		}
+		images = append(images, cachedImage{name, stat.Size(), stat.ModTime()})
+		total += stat.Size()
+	}
+	if total <= int64(app.cacheMaxSize) {
+		return
+	}
+
+	sort.Slice(images, func(i, j int) bool { return images[i].used.Before(images[j].used) })
+	var count int
+	var evicted int64
+	for _, img := range images {
+		if total <= int64(app.cacheMaxSize) {
+			break
+		}
+		if inUse[img.name] {
+			continue
+		}
+		err := os.Remove(filepath.Join(app.cache.Path, cacheImageFolder, img.name))
+		if err != nil {
+			logWarn("could not evict %s: %v", img.name, err)
+			continue
+		}
+		_ = app.manifest.forgetImage(img.name)
+		count++
+		evicted += img.size
+		total -= img.size
+	}
+	countLog(count).info("evicted %d images (%d KB) from the cache to keep it under %s", count, evicted/1024, &app.cacheMaxSize)
+	if total > int64(app.cacheMaxSize) {
+		logWarn("images of this deck alone take %d KB, more than --cache-max-size %s", total/1024, &app.cacheMaxSize)
+	}
+}
+
+// Temporary files older than this are left over from interrupted runs.
+const staleTempAge = time.Hour
+
+// Retries of a rename refused on Windows; see renameOver.
+const (
+	renameRetries    = 10
+	renameRetryDelay = 50 * time.Millisecond
+)
+
+// imageExpired reports whether a cached image was fetched longer ago than
+// --image-cache-ttl.  Images of unknown age, cached by earlier versions,
+// count as expired.  Nothing expires in a read-only cache.
+func (app *App) imageExpired(card XMLCard) bool {
+	if app.imageCacheTTL <= 0 || app.cacheReadOnly {
+		return false
+	}
+	fetched, ok := app.manifest.imageFetched(card.ImagePath)
+	if ok && time.Since(fetched) <= app.imageCacheTTL {
+		return false
+	}
+	imageLog(card.ImagePath).debug("cached %s has expired", card.ImagePath)
+	return true
+}
+
+// removeStaleTempFiles deletes temporary files that writeCacheFile never
+// renamed into place because the run was killed.  Recent ones may belong to
+// a run still in progress and are kept.
+func removeStaleTempFiles(cache *configdir.Config) {
+	_ = filepath.Walk(cache.Path, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || filepath.Ext(p) != ".tmp" {
+			return nil
+		}
+		if time.Since(info.ModTime()) > staleTempAge {
+			logDebug("removing stale temporary file %s", p)
+			_ = os.Remove(p)
+		}
+		return nil
+	})
+}
+
+// cacheCommand runs the "cache" subcommand and returns the exit status.
+func (app *App) cacheCommand(args []string) int {
+	switch {
+	case len(args) == 1 && args[0] == "info":
+		return app.cacheInfo()
+	case len(args) == 1 && args[0] == "verify":
+		return app.cacheVerify()
+	default:
+		fmt.Fprintf(os.Stderr, "usage: %s [options] cache info|verify\n", os.Args[0])
+		return exitUsage
+	}
+}
+
+func (app *App) cacheInfo() int {
+	fmt.Printf("cache: %s (format version %d)\n", app.cache.Path, app.manifest.FormatVersion)
+
+	dbPath := filepath.Join(app.cache.Path, app.cacheDBFile())
+	if stat, err := os.Stat(dbPath); err == nil {
+		fmt.Printf("metadata: %s (updated %s)\n", dbPath, stat.ModTime().Format(time.RFC3339))
+	} else {
+		fmt.Printf("metadata: %s (not cached)\n", dbPath)
+	}
+
+	var count int
+	var size int64
+	err := filepath.Walk(filepath.Join(app.cache.Path, cacheImageFolder), func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			count++
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return exitFailure
+	}
+	fmt.Printf("images: %d files, %d KB\n", count, size/1024)
+	return exitOK
+}
+
+// cacheVerify checks every cached image against its checksum.  Corrupt
+// images are removed, unless the cache is read-only, so they are fetched
+// again; images without a checksum get one.  It fails if any image was
+// corrupt.
+func (app *App) cacheVerify() int {
+	var ok, corrupt, added int
+	for _, name := range cachedImages(app.cache) {
+		data, err := ioutil.ReadFile(filepath.Join(app.cache.Path, cacheImageFolder, name))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return exitFailure
+		}
+		want, known := app.manifest.Images[name]
+		switch {
+		case !known:
+			err = app.manifest.recordImage(name, data)
+			added++
+		case checksum(data) == want:
+			ok++
+		default:
+			fmt.Printf("corrupt: %s\n", name)
+			corrupt++
+			if !app.cacheReadOnly {
+				err = os.Remove(filepath.Join(app.cache.Path, cacheImageFolder, name))
+				if err == nil {
+					err = app.manifest.forgetImage(name)
+				}
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return exitFailure
+		}
+	}
+
+	// Drop checksums of images that are gone.
+	for name := range app.manifest.Images {
+		if _, err := os.Stat(filepath.Join(app.cache.Path, cacheImageFolder, name)); os.IsNotExist(err) {
+			_ = app.manifest.forgetImage(name)
+		}
+	}
+
+	fmt.Printf("images: %d ok, %d corrupt, %d newly checksummed\n", ok, corrupt, added)
+	if corrupt > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,206 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shibukawa/configdir"
+)
+
+func TestGzipRoundTrip(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("{}"), bytes.Repeat([]byte("Gandalf "), 10000)} {
+		zipped, err := gzipBytes(data)
+		if err != nil {
+			t.Fatalf("gzipBytes: %v", err)
+		}
+		got, err := gunzip(zipped)
+		if err != nil {
+			t.Fatalf("gunzip: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("round trip of %d bytes gave %d bytes", len(data), len(got))
+		}
+	}
+}
+
+func TestMetadataCacheRoundTrip(t *testing.T) {
+	cache, manifest, cleanup := newTestCache(t)
+	defer cleanup()
+
+	cards := map[string]CardInfo{
+		"51223bd0-ffd1-11df-a976-0801200c9001": {Name: "Aragorn", Code: "01001", Image: "01001.png", Cost: "12", Sphere: "Leadership", Type: "Hero", Pack: "Core"},
+		"51223bd0-ffd1-11df-a976-0801200c9050": {Name: "Éowyn", Image: "01050.png", Cost: "X", EncounterSet: "Passage Through Mirkwood", Quantity: 3},
+	}
+	err := saveToCache(cache, manifest, "cards.json.gz", cards, `"v1"`)
+	if err != nil {
+		t.Fatalf("saveToCache: %v", err)
+	}
+	got, stale, err := loadFromCache(cache, manifest, "cards.json.gz")
+	if err != nil || stale {
+		t.Fatalf("loadFromCache: stale %v, error %v", stale, err)
+	}
+	if !reflect.DeepEqual(got, cards) {
+		t.Errorf("loaded %+v, want %+v", got, cards)
+	}
+}
+
+func TestTruncatedMetadataRefetched(t *testing.T) {
+	body, err := json.Marshal([]RingsCard{{ID: "51223bd0-ffd1-11df-a976-0801200c9001", Name: "Aragorn", ImageSrc: "/bundles/cards/01001.png"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := newFakeSite(map[string][]byte{"/api/public/cards/": body})
+	defer site.Close()
+	app, cleanup := newTestApp(t, site.URL)
+	defer cleanup()
+
+	// A run killed by an earlier version may leave the file cut short.
+	err = saveToCache(app.cache, app.manifest, app.cacheDBFile(), map[string]CardInfo{"x": {Name: "Old"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(app.cache.Path, app.cacheDBFile())
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, data[:len(data)/2], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadFromCache(app.cache, app.manifest, app.cacheDBFile()); err == nil {
+		t.Fatal("loadFromCache read a truncated file")
+	}
+
+	app.LoadMetadata()
+	if app.err != nil {
+		t.Fatalf("LoadMetadata: %v", app.err)
+	}
+	if n := site.count("/api/public/cards/"); n != 1 {
+		t.Errorf("metadata fetched %d times, want 1", n)
+	}
+	if len(app.octgnToCard) != 1 || app.octgnToCard["51223bd0-ffd1-11df-a976-0801200c9001"].Name != "Aragorn" {
+		t.Errorf("loaded metadata %+v", app.octgnToCard)
+	}
+	cached, _, err := loadFromCache(app.cache, app.manifest, app.cacheDBFile())
+	if err != nil || len(cached) != 1 {
+		t.Errorf("refetched metadata not cached: %v %v", cached, err)
+	}
+}
+
+// tempFiles lists the temporary files left anywhere in the cache.
+func tempFiles(t *testing.T, cache *configdir.Config) []string {
+	var names []string
+	err := filepath.Walk(cache.Path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && filepath.Ext(p) == ".tmp" {
+			names = append(names, p)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestWriteCacheFile(t *testing.T) {
+	cache, _, cleanup := newTestCache(t)
+	defer cleanup()
+
+	name := filepath.Join(cacheImageFolder, "Core", "001.png")
+	for _, data := range []string{"first", "second"} {
+		err := writeCacheFile(cache, name, []byte(data))
+		if err != nil {
+			t.Fatalf("writeCacheFile: %v", err)
+		}
+		got, err := cache.ReadFile(name)
+		if err != nil || string(got) != data {
+			t.Errorf("cached file is %q, error %v; want %q", got, err, data)
+		}
+	}
+	if debris := tempFiles(t, cache); len(debris) > 0 {
+		t.Errorf("temporary files left: %v", debris)
+	}
+}
+
+func TestWriteCacheFileInterrupted(t *testing.T) {
+	cache, _, cleanup := newTestCache(t)
+	defer cleanup()
+
+	// A run killed while writing leaves only its temporary file behind.
+	err := writeCacheFile(cache, "cards.json.gz", []byte("complete"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(cache.Path, "cards.json.gz.123.tmp"), []byte("compl"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := cache.ReadFile("cards.json.gz")
+	if err != nil || string(got) != "complete" {
+		t.Errorf("cached file is %q, error %v; want the old contents", got, err)
+	}
+
+	// A write that fails cleans up after itself.  Renaming over a
+	// directory that isn't empty fails on every platform.
+	err = os.MkdirAll(filepath.Join(cache.Path, "blocked", "inside"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writeCacheFile(cache, "blocked", []byte("data")) == nil {
+		t.Fatal("writeCacheFile over a directory succeeded")
+	}
+	debris := tempFiles(t, cache)
+	if len(debris) != 1 || filepath.Base(debris[0]) != "cards.json.gz.123.tmp" {
+		t.Errorf("temporary files left: %v", debris)
+	}
+}
+
+func TestRemoveStaleTempFiles(t *testing.T) {
+	cache, _, cleanup := newTestCache(t)
+	defer cleanup()
+
+	old := time.Now().Add(-2 * staleTempAge)
+	files := []struct {
+		name    string
+		old     bool
+		removed bool
+	}{
+		{"cards.json.gz.1.tmp", true, true},
+		{filepath.Join(cacheImageFolder, "Core", "001.png.2.tmp"), true, true},
+		{filepath.Join(cacheImageFolder, "Core", "002.png.3.tmp"), false, false}, // may be another run's
+		{filepath.Join(cacheImageFolder, "Core", "003.png"), true, false},
+	}
+	for _, f := range files {
+		path := filepath.Join(cache.Path, f.name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte("data"), 0644)
+		}
+		if err == nil && f.old {
+			err = os.Chtimes(path, old, old)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removeStaleTempFiles(cache)
+	for _, f := range files {
+		if got := !cache.Exists(f.name); got != f.removed {
+			t.Errorf("%s removed: %v, want %v", f.name, got, f.removed)
+		}
+	}
+}
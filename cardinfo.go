@@ -0,0 +1,71 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+)
+
+// cardInfoEntry is what --card-info-json records about each card.  Cost is
+// null if it isn't a number, such as X.
+type cardInfoEntry struct {
+	OctgnID   string `json:"octgn_id"`
+	Name      string `json:"name"`
+	Sphere    string `json:"sphere"`
+	Type      string `json:"type"`
+	Cost      *int   `json:"cost"`
+	Quantity  int    `json:"quantity"`
+	ImagePath string `json:"image_path"`
+	Cached    bool   `json:"cached"`
+}
+
+// WriteCardInfo writes the resolved metadata of each distinct card in the
+// deck, in deck order, if --card-info-json was given.
+func (app *App) WriteCardInfo() {
+	if app.err != nil || app.cardInfoJSON == "" {
+		return
+	}
+	defer app.failed(stageOutput)
+
+	entries := make([]cardInfoEntry, 0)
+	index := make(map[string]int)
+	for _, card := range app.deck {
+		if i, ok := index[card.OctgnID]; ok {
+			entries[i].Quantity += card.Quantity
+			continue
+		}
+		entry := cardInfoEntry{
+			OctgnID:   card.OctgnID,
+			Name:      card.Name,
+			Sphere:    card.Sphere,
+			Type:      card.Type,
+			Quantity:  card.Quantity,
+			ImagePath: imageFile(app.cache, card),
+			Cached:    card.Override,
+		}
+		if n, err := strconv.Atoi(card.Cost); err == nil {
+			entry.Cost = &n
+		}
+		if !card.Override {
+			_, entry.Cached = app.manifest.checkImage(card.ImagePath)
+		}
+		index[card.OctgnID] = len(entries)
+		entries = append(entries, entry)
+	}
+
+	var data []byte
+	data, app.err = json.MarshalIndent(entries, "", "  ")
+	if app.err != nil {
+		return
+	}
+	app.err = ioutil.WriteFile(app.cardInfoJSON, append(data, '\n'), 0644)
+	if app.err == nil {
+		countLog(len(entries)).info("wrote %d cards to %s", len(entries), app.cardInfoJSON)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Section holding the cards given with --card.
+const namedCardsSectionName = "Cards"
+
+// cardSpec is a card given by name with --card, such as
+// "Gandalf (Core Set):3".
+type cardSpec struct {
+	Name     string
+	Pack     string // pack name or code, if given in parentheses
+	Quantity int
+}
+
+func (cs cardSpec) String() string {
+	if cs.Pack == "" {
+		return cs.Name
+	}
+	return fmt.Sprintf("%s (%s)", cs.Name, cs.Pack)
+}
+
+// parseCardSpec parses a --card value: a card name, optionally followed by
+// a pack name or code in parentheses, and optionally by a colon and the
+// number of copies, which defaults to 1.
+func parseCardSpec(s string) (cardSpec, error) {
+	spec := cardSpec{Name: strings.TrimSpace(s), Quantity: 1}
+	if i := strings.LastIndexByte(spec.Name, ':'); i >= 0 {
+		qty, err := strconv.Atoi(strings.TrimSpace(spec.Name[i+1:]))
+		if err == nil {
+			if qty < 1 {
+				return cardSpec{}, fmt.Errorf("--card %q: quantity must be positive", s)
+			}
+			spec.Name, spec.Quantity = strings.TrimSpace(spec.Name[:i]), qty
+		}
+	}
+	if strings.HasSuffix(spec.Name, ")") {
+		if i := strings.LastIndexByte(spec.Name, '('); i > 0 {
+			spec.Pack = strings.TrimSpace(spec.Name[i+1 : len(spec.Name)-1])
+			spec.Name = strings.TrimSpace(spec.Name[:i])
+		}
+	}
+	if spec.Name == "" {
+		return cardSpec{}, fmt.Errorf("--card %q: no card name", s)
+	}
+	return spec, nil
+}
+
+// namedCardsSection returns a section of the cards given with --card.
+func (app *App) namedCardsSection() (XMLSection, error) {
+	section := XMLSection{Name: namedCardsSectionName}
+	for _, spec := range app.cardSpecs {
+		id, err := app.resolveCardName(spec)
+		if err != nil {
+			return XMLSection{}, err
+		}
+		section.Cards = append(section.Cards, XMLCard{
+			Card:     app.octgnToCard[id].Name,
+			Quantity: spec.Quantity,
+			OctgnID:  id,
+		})
+	}
+	return section, nil
+}
+
+// resolveCardName returns the OCTGN ID of the one card in the metadata with
+// the given name, and pack if any, ignoring case.  If several cards match,
+// such as reprints, the user is asked to choose one when app.interactive is
+// set; otherwise it is an error listing each with its pack.  A choice holds
+// for the rest of the run.
+func (app *App) resolveCardName(spec cardSpec) (string, error) {
+	key := strings.ToLower(spec.String())
+	if id, ok := app.nameChoices[key]; ok {
+		return id, nil
+	}
+
+	var ids []string
+	for id, info := range app.octgnToCard {
+		if !strings.EqualFold(info.Name, spec.Name) {
+			continue
+		}
+		if spec.Pack != "" && !strings.EqualFold(info.Pack, spec.Pack) && !strings.EqualFold(info.PackName, spec.Pack) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("no card named %q in the card metadata", spec)
+	case 1:
+		return ids[0], nil
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := app.octgnToCard[ids[i]], app.octgnToCard[ids[j]]
+		if a.PackName != b.PackName {
+			return a.PackName < b.PackName
+		}
+		return ids[i] < ids[j]
+	})
+	candidates := make([]string, len(ids))
+	for i, id := range ids {
+		info := app.octgnToCard[id]
+		pack := info.PackName
+		if pack == "" {
+			pack = info.Pack
+		}
+		candidates[i] = fmt.Sprintf("%s (%s) [%s]", info.Name, pack, id)
+	}
+
+	if app.interactive {
+		i, err := app.chooseCandidate(os.Stderr, app.stdin(), spec, ids)
+		if err == nil {
+			app.nameChoices[key] = ids[i]
+			return ids[i], nil
+		}
+		if err != io.EOF {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("card name %q is ambiguous; give a pack to choose one of: %s",
+		spec, strings.Join(candidates, ", "))
+}
+
+// chooseCandidate asks which of several cards matching spec is meant and
+// returns its index.  It asks again after an unusable answer and returns
+// io.EOF if there is no more input.
+func (app *App) chooseCandidate(w io.Writer, r *bufio.Reader, spec cardSpec, ids []string) (int, error) {
+	fmt.Fprintf(w, "%q matches %d cards:\n", spec, len(ids))
+	for i, id := range ids {
+		info := app.octgnToCard[id]
+		fmt.Fprintf(w, "  %d) %s, %s (%s) [%s]\n", i+1, info.Name, info.PackName, info.Pack, id)
+	}
+	for {
+		fmt.Fprintf(w, "Print which one? [1-%d] ", len(ids))
+		line, err := r.ReadString('\n')
+		if n, convErr := strconv.Atoi(strings.TrimSpace(line)); convErr == nil && n >= 1 && n <= len(ids) {
+			return n - 1, nil
+		}
+		if err != nil {
+			fmt.Fprintln(w)
+			return 0, err
+		}
+	}
+}
+
+// stdin returns a reader of standard input shared by all prompts.
+func (app *App) stdin() *bufio.Reader {
+	if app.stdinReader == nil {
+		app.stdinReader = bufio.NewReader(os.Stdin)
+	}
+	return app.stdinReader
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
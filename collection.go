@@ -0,0 +1,110 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// collection holds the owned quantity of each card listed in an --own file,
+// keyed by OCTGN ID or by lowercased card name.
+type collection struct {
+	byID   map[string]int
+	byName map[string]int
+}
+
+// readCollection reads a file of owned cards.  Each line holds an OCTGN ID
+// or card name and, after a comma, the number of copies owned, which
+// defaults to 1.  Blank lines and lines starting with '#' are ignored.
+// Entries that are neither a known OCTGN ID nor the name of a known card
+// are counted by name and warned about.
+func readCollection(name string, cards map[string]CardInfo) (collection, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return collection{}, err
+	}
+	defer f.Close()
+
+	names := make(map[string]bool, len(cards))
+	for _, info := range cards {
+		names[strings.ToLower(info.Name)] = true
+	}
+
+	owned := collection{byID: make(map[string]int), byName: make(map[string]int)}
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return collection{}, fmt.Errorf("%s: %v", name, err)
+		}
+		card := strings.TrimSpace(record[0])
+		if card == "" {
+			continue
+		}
+		qty := 1
+		if len(record) > 1 {
+			qty, err = strconv.Atoi(strings.TrimSpace(record[1]))
+			if err != nil || qty < 0 {
+				return collection{}, fmt.Errorf("%s: bad quantity %q for %s", name, record[1], card)
+			}
+		}
+		if _, ok := cards[card]; ok {
+			owned.byID[card] += qty
+			continue
+		}
+		key := strings.ToLower(card)
+		if len(cards) > 0 && !names[key] {
+			logWarn("%s: unknown card %q", name, card)
+		}
+		owned.byName[key] += qty
+	}
+	return owned, nil
+}
+
+// subtract removes owned copies from the deck, matching by OCTGN ID first
+// and then by name, and drops cards with no copies left.  Each owned copy is
+// used up by at most one deck card.  It returns the remaining cards and the
+// number of copies removed.
+func (c collection) subtract(deck []XMLCard) ([]XMLCard, int) {
+	kept := make([]XMLCard, 0, len(deck))
+	removed := 0
+	for _, card := range deck {
+		for _, pool := range []struct {
+			m   map[string]int
+			key string
+		}{
+			{c.byID, card.OctgnID},
+			{c.byName, strings.ToLower(card.Name)},
+		} {
+			n := pool.m[pool.key]
+			if n <= 0 {
+				continue
+			}
+			if n > card.Quantity {
+				n = card.Quantity
+			}
+			pool.m[pool.key] -= n
+			card.Quantity -= n
+			removed += n
+		}
+		if card.Quantity > 0 {
+			kept = append(kept, card)
+		}
+	}
+	return kept, removed
+}
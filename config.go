@@ -0,0 +1,163 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/shibukawa/configdir"
+)
+
+const configFileName = "config.toml"
+
+// configFilePath is the location of the config file in the global config
+// folder.
+func configFilePath() string {
+	folders := configdir.New(vendorName, appConfigName).QueryFolders(configdir.Global)
+	return filepath.Join(folders[0].Path, configFileName)
+}
+
+// applyConfigFile sets each option in the config file, if there is one,
+// whose flag wasn't given on the command line.  The file holds lines of
+// "option = value", where values may be quoted, and "#" starts a comment.
+func applyConfigFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		name, value, err := parseConfigLine(scanner.Text())
+		if err == nil && name != "" && flag.Lookup(name) == nil {
+			err = fmt.Errorf("unknown option %q", name)
+		}
+		if err == nil && name != "" && !flagWasSet(name) {
+			err = flag.Set(name, value)
+		}
+		if err != nil {
+			return fmt.Errorf("config file %s, line %d: %v", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseConfigLine returns the option and value on a config file line, or an
+// empty name for a blank or comment line.
+func parseConfigLine(line string) (string, string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", nil
+	}
+	i := strings.Index(line, "=")
+	if i < 0 {
+		return "", "", errors.New(`expected "option = value"`)
+	}
+	name := strings.TrimSpace(line[:i])
+	value := strings.TrimSpace(line[i+1:])
+	if strings.HasPrefix(value, `"`) {
+		end := closingQuote(value)
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		unquoted, err := strconv.Unquote(value[:end+1])
+		if err != nil {
+			return "", "", err
+		}
+		rest := strings.TrimSpace(value[end+1:])
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", "", fmt.Errorf("unexpected %q after value", rest)
+		}
+		return name, unquoted, nil
+	}
+	if j := strings.Index(value, "#"); j >= 0 {
+		value = strings.TrimSpace(value[:j])
+	}
+	return name, value, nil
+}
+
+// closingQuote returns the index of the quote ending the string that starts
+// s, or -1.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// configCommand runs the "config" subcommand and returns the exit status.
+func configCommand(args []string) int {
+	if len(args) != 1 || args[0] != "init" {
+		fmt.Fprintf(os.Stderr, "usage: %s config init\n", os.Args[0])
+		return exitUsage
+	}
+
+	path := configFilePath()
+	if _, err := os.Stat(path); err == nil {
+		fmt.Fprintf(os.Stderr, "config file %s already exists\n", path)
+		return exitFailure
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path, configTemplate(), 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return exitFailure
+	}
+	fmt.Printf("wrote %s\n", path)
+	return exitOK
+}
+
+// Options that make no sense as defaults, left out of the config template
+// along with the aliases of other options.
+var configTemplateSkip = map[string]bool{"version": true}
+
+// configTemplate lists every option, commented out with its default value.
+func configTemplate() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Default options for " + filepath.Base(os.Args[0]) + ".  Options given on the\n")
+	buf.WriteString("# command line take precedence.  Uncomment a line to change its default.\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		if configTemplateSkip[f.Name] || canonicalFlag(f.Name) != f.Name {
+			return
+		}
+		fmt.Fprintf(&buf, "\n# %s\n", strings.Replace(f.Usage, "`", "", -1))
+		fmt.Fprintf(&buf, "# %s = %s\n", f.Name, configValue(f))
+	})
+	return buf.Bytes()
+}
+
+func configValue(f *flag.Flag) string {
+	if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+		if f.DefValue == "" {
+			return "false"
+		}
+		return f.DefValue
+	}
+	if _, err := strconv.ParseFloat(f.DefValue, 64); err == nil {
+		return f.DefValue
+	}
+	return strconv.Quote(f.DefValue)
+}
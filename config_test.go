@@ -0,0 +1,60 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyConfigFileAliases(t *testing.T) {
+	commandLine := flag.CommandLine
+	defer func() { flag.CommandLine = commandLine }()
+
+	var output, format, sortBy, lang string
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	flag.StringVar(&output, "output", "", "")
+	flag.StringVar(&output, "o", "", "")
+	flag.StringVar(&format, "format", "pdf", "")
+	flag.StringVar(&format, "output-format", "pdf", "")
+	flag.StringVar(&sortBy, "sort-by", "", "")
+	flag.StringVar(&lang, "lang", "", "")
+	err := flag.CommandLine.Parse([]string{"-o", "deck.pdf", "--output-format", "png", "--lang", "fr"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "lotrproxypdf-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, configFileName)
+	config := "output = \"config.pdf\"\nformat = html\nsort-by = name  # from the file\nlang = de\n"
+	err = ioutil.WriteFile(path, []byte(config), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = applyConfigFile(path)
+	if err != nil {
+		t.Fatalf("applyConfigFile: %v", err)
+	}
+	for _, opt := range []struct{ name, got, want string }{
+		{"output", output, "deck.pdf"}, // given as -o
+		{"format", format, "png"},      // given as --output-format
+		{"sort-by", sortBy, "name"},
+		{"lang", lang, "fr"},
+	} {
+		if opt.got != opt.want {
+			t.Errorf("%s is %q, want %q", opt.name, opt.got, opt.want)
+		}
+	}
+}
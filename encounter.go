@@ -0,0 +1,96 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Most edits a mistyped encounter set name may be from a suggestion.
+const maxSuggestionDistance = 3
+
+// encounterSetDeck builds a deck of every card in the --encounter-set sets,
+// one section per set in the order given.  Set names are matched without
+// regard to case.
+func (app *App) encounterSetDeck() (XMLDeck, error) {
+	sets := make(map[string][]XMLCard)
+	names := make(map[string]string) // lowercased to as in the metadata
+	for id, info := range app.octgnToCard {
+		if info.EncounterSet == "" {
+			continue
+		}
+		key := strings.ToLower(info.EncounterSet)
+		names[key] = info.EncounterSet
+		qty := info.Quantity
+		if qty < 1 {
+			qty = 1
+		}
+		sets[key] = append(sets[key], XMLCard{Card: info.Name, Quantity: qty, OctgnID: id})
+	}
+
+	var deck XMLDeck
+	for _, want := range app.encounterSets {
+		key := strings.ToLower(strings.TrimSpace(want))
+		cards, ok := sets[key]
+		if !ok {
+			return XMLDeck{}, unknownEncounterSet(want, names)
+		}
+		sort.Slice(cards, func(i, j int) bool {
+			if cards[i].Card != cards[j].Card {
+				return cards[i].Card < cards[j].Card
+			}
+			return cards[i].OctgnID < cards[j].OctgnID
+		})
+		countLog(len(cards)).info("encounter set %q has %d cards", names[key], len(cards))
+		deck.Sections = append(deck.Sections, XMLSection{Name: names[key], Cards: cards})
+	}
+	return deck, nil
+}
+
+// unknownEncounterSet returns an error for a set name not in the metadata,
+// suggesting the known names that contain it or are a few edits from it.
+func unknownEncounterSet(want string, names map[string]string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("no encounter sets in the card metadata")
+	}
+	key := strings.ToLower(strings.TrimSpace(want))
+	var close []string
+	for k, name := range names {
+		if strings.Contains(k, key) || editDistance(k, key) <= maxSuggestionDistance {
+			close = append(close, fmt.Sprintf("%q", name))
+		}
+	}
+	if len(close) == 0 {
+		return fmt.Errorf("unknown encounter set %q", want)
+	}
+	sort.Strings(close)
+	return fmt.Errorf("unknown encounter set %q; did you mean %s?", want, strings.Join(close, " or "))
+}
+
+// editDistance is the Levenshtein distance between a and b, counting runes.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
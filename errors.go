@@ -0,0 +1,75 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import "errors"
+
+// Exit codes, so scripts can tell failures apart.
+const (
+	exitOK        = 0
+	exitFailure   = 1 // anything not covered below, e.g. an unusable cache
+	exitUsage     = 2 // bad command line, options or config file
+	exitInput     = 3 // unreadable or unparseable deck
+	exitMetadata  = 4 // card metadata could not be loaded
+	exitImages    = 5 // card images could not be downloaded or prepared
+	exitOutput    = 6 // PDF or other output could not be rendered or written
+	exitCancelled = 7 // interrupted, or --timeout ran out
+)
+
+// Pipeline stages an AppError can come from.
+const (
+	stageMetadata = "metadata"
+	stageInput    = "input"
+	stageImages   = "images"
+	stageOutput   = "output"
+)
+
+// AppError is an error from a stage of the App pipeline.
+type AppError struct {
+	Stage string
+	Err   error
+}
+
+func (e *AppError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+// exitCode returns the exit code for an error from the App pipeline.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var appErr *AppError
+	if !errors.As(err, &appErr) {
+		return exitFailure
+	}
+	switch appErr.Stage {
+	case stageMetadata:
+		return exitMetadata
+	case stageInput:
+		return exitInput
+	case stageImages:
+		return exitImages
+	case stageOutput:
+		return exitOutput
+	default:
+		return exitFailure
+	}
+}
+
+// failed marks any error the current stage left in app.err as coming from
+// that stage.  Stages defer it after checking for earlier errors.
+func (app *App) failed(stage string) {
+	var appErr *AppError
+	if app.err != nil && !errors.As(app.err, &appErr) {
+		app.err = &AppError{Stage: stage, Err: app.err}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	cause := errors.New("boom")
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, exitOK},
+		{"plain error", cause, exitFailure},
+		{"metadata", &AppError{Stage: stageMetadata, Err: cause}, exitMetadata},
+		{"input", &AppError{Stage: stageInput, Err: cause}, exitInput},
+		{"images", &AppError{Stage: stageImages, Err: cause}, exitImages},
+		{"output", &AppError{Stage: stageOutput, Err: cause}, exitOutput},
+		{"unknown stage", &AppError{Stage: "other", Err: cause}, exitFailure},
+		{"wrapped", fmt.Errorf("deck.o8d: %w", &AppError{Stage: stageInput, Err: cause}), exitInput},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("%s: exitCode(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFailedKeepsFirstStage(t *testing.T) {
+	app := &App{err: errors.New("bad deck")}
+	app.failed(stageInput)
+	app.failed(stageOutput)
+	if got := exitCode(app.err); got != exitInput {
+		t.Errorf("exit code %d, want %d", got, exitInput)
+	}
+}
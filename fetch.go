@@ -0,0 +1,138 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// fetcher makes all HTTP requests of a run through one client, so
+// connections are reused, and one rate limiter.  The servers it talks to
+// come from the Game and the command line, so a fetcher whose client
+// reaches a local test server can stand in for the real sites.
+type fetcher struct {
+	client  *http.Client
+	limiter *rateLimiter // spaces out GET requests; nil means no limit
+}
+
+// newFetcher returns a fetcher that waits at most timeout for a server to
+// start responding and sends at most rate GET requests per second, if rate
+// isn't zero.
+func newFetcher(timeout time.Duration, rate float64) *fetcher {
+	return &fetcher{
+		client:  &http.Client{Transport: newHTTPTransport(timeout)},
+		limiter: newRateLimiter(rate),
+	}
+}
+
+// newHTTPTransport returns a transport that waits at most timeout for a
+// server to start responding.  Bodies have no deadline of their own, since
+// the metadata download is several megabytes and slow links need longer.
+func newHTTPTransport(timeout time.Duration) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = timeout
+	t.MaxIdleConnsPerHost = 16
+	return t
+}
+
+// getBytes is get without the headers.
+func (f *fetcher) getBytes(ctx context.Context, url string, timeout time.Duration) ([]byte, error) {
+	body, _, err := f.get(ctx, url, timeout)
+	return body, err
+}
+
+// get returns the body and headers of a successful GET of url, allowing
+// each attempt timeout, if not zero.  Attempts wait their turn with the
+// rate limiter before the deadline starts, and a 429 response is retried
+// after the wait the server asks for.
+func (f *fetcher) get(ctx context.Context, url string, timeout time.Duration) ([]byte, http.Header, error) {
+	for attempt := 0; ; attempt++ {
+		err := f.limiter.wait(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, header, wait, err := f.getOnce(ctx, url, timeout)
+		if wait == 0 || attempt == maxRetries {
+			return body, header, err
+		}
+		logDebug("retrying %s in %v", url, wait.Round(time.Second))
+		err = sleepContext(ctx, wait)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// getOnce fetches url.  If the server answers 429 Too Many Requests, it
+// also returns how long to wait before trying again.
+func (f *fetcher) getOnce(ctx context.Context, url string, timeout time.Duration) ([]byte, http.Header, time.Duration, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	start := time.Now()
+	resp, err := f.client.Do(req)
+	if err != nil {
+		logDebug("GET %s: %v", url, err)
+		return nil, nil, 0, err
+	}
+	defer resp.Body.Close()
+	logDebug("GET %s: %s (%v)", url, resp.Status, time.Since(start).Round(time.Millisecond))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := retryAfter(resp)
+		if wait <= 0 {
+			wait = time.Millisecond
+		}
+		return nil, nil, wait, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	body, err := httpBody(url, resp)
+	return body, resp.Header, 0, err
+}
+
+func httpBody(url string, resp *http.Response) ([]byte, error) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// put uploads data to url, allowing remotePutTimeout.
+func (f *fetcher) put(ctx context.Context, url string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, remotePutTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := f.client.Do(req)
+	if err != nil {
+		logDebug("PUT %s: %v", url, err)
+		return err
+	}
+	defer resp.Body.Close()
+	logDebug("PUT %s: %s", url, resp.Status)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %s: %s", url, resp.Status)
+	}
+	return nil
+}
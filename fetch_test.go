@@ -0,0 +1,225 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shibukawa/configdir"
+)
+
+func TestMain(m *testing.M) {
+	verbosity = levelQuiet
+	os.Exit(m.Run())
+}
+
+// fakeSite stands in for a card database: it serves files by path and
+// counts the requests for each.
+type fakeSite struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	files    map[string][]byte
+	requests map[string]int
+
+	// handle, if set, is called before a request is answered.
+	handle func(path string)
+}
+
+func newFakeSite(files map[string][]byte) *fakeSite {
+	s := &fakeSite{files: files, requests: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		data, ok := s.files[r.URL.Path]
+		s.mu.Unlock()
+		if s.handle != nil {
+			s.handle(r.URL.Path)
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(data)
+	}))
+	return s
+}
+
+func (s *fakeSite) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// newTestCache returns an empty cache in a temporary folder, its manifest
+// and a function that removes it.
+func newTestCache(t testing.TB) (*configdir.Config, *cacheManifest, func()) {
+	dir, err := ioutil.TempDir("", "lotrproxypdf-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := openCache(dir, appConfigName, "")
+	return cache, openManifest(cache, false), func() { os.RemoveAll(dir) }
+}
+
+// newTestApp returns an App using a new test cache and the card database
+// at siteURL, and a function that removes the cache.
+func newTestApp(t testing.TB, siteURL string) (*App, func()) {
+	cache, manifest, cleanup := newTestCache(t)
+	game := games["lotr"].WithURLs(siteURL+"/api/public/cards/", siteURL, "/bundles/cards/")
+	app := &App{
+		ctx:            context.Background(),
+		cache:          cache,
+		manifest:       manifest,
+		fetch:          newFetcher(5*time.Second, 0),
+		asyncSaves:     &sync.WaitGroup{},
+		game:           game,
+		metadataUpdate: updateEager,
+		imageSources: imageSources{
+			Order:       []string{sourceRingsDB},
+			SiteURL:     game.SiteURL,
+			ImagePrefix: game.ImagePrefix,
+		},
+		imageTimeout: 5 * time.Second,
+	}
+	return app, cleanup
+}
+
+func TestLoadMetadataCacheMiss(t *testing.T) {
+	cards := []RingsCard{
+		{ID: "51223bd0-ffd1-11df-a976-0801200c9001", Code: "01001", Name: "Aragorn", ImageSrc: "/bundles/cards/01001.png", PackCode: "Core"},
+		{ID: "51223bd0-ffd1-11df-a976-0801200c9002", Code: "01002", Name: "Théodred", ImageSrc: "/bundles/cards/01002.png", PackCode: "Core"},
+	}
+	body, err := json.Marshal(cards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := newFakeSite(map[string][]byte{"/api/public/cards/": body})
+	defer site.Close()
+	app, cleanup := newTestApp(t, site.URL)
+	defer cleanup()
+
+	app.LoadMetadata()
+	if app.err != nil {
+		t.Fatalf("LoadMetadata: %v", app.err)
+	}
+	if n := site.count("/api/public/cards/"); n != 1 {
+		t.Errorf("metadata fetched %d times, want 1", n)
+	}
+	got := app.octgnToCard["51223bd0-ffd1-11df-a976-0801200c9002"]
+	if got.Name != "Théodred" || got.Image != "01002.png" {
+		t.Errorf("metadata for Théodred is %+v", got)
+	}
+
+	// It is now cached, with the ETag, and isn't fetched again.
+	cached, stale, err := loadFromCache(app.cache, app.manifest, app.cacheDBFile())
+	if err != nil || stale || len(cached) != len(cards) {
+		t.Fatalf("loadFromCache: %d cards, stale %v, error %v", len(cached), stale, err)
+	}
+	if rec, _ := app.manifest.metadata(app.cacheDBFile()); rec.ETag != `"v1"` {
+		t.Errorf("cached ETag is %q", rec.ETag)
+	}
+	app.octgnToCard = nil
+	app.LoadMetadata()
+	if app.err != nil || len(app.octgnToCard) != len(cards) {
+		t.Fatalf("LoadMetadata from cache: %d cards, error %v", len(app.octgnToCard), app.err)
+	}
+	if n := site.count("/api/public/cards/"); n != 1 {
+		t.Errorf("metadata fetched %d times, want 1", n)
+	}
+}
+
+func TestFetchImagesNotFound(t *testing.T) {
+	site := newFakeSite(map[string][]byte{"/bundles/cards/01001.png": []byte("image 01001")})
+	defer site.Close()
+	app, cleanup := newTestApp(t, site.URL)
+	defer cleanup()
+
+	deck := []XMLCard{
+		{Card: "Aragorn", ImagePath: "01001.png"},
+		{Card: "Gimli", ImagePath: "01004.png"},
+	}
+	failed, err := app.fetchImages(deck)
+	if err != nil {
+		t.Fatalf("fetchImages: %v", err)
+	}
+	if len(failed) != 1 || failed["01004.png"] == nil {
+		t.Fatalf("failed images are %v, want just 01004.png", failed)
+	}
+	if !strings.Contains(failed["01004.png"].Error(), "404") {
+		t.Errorf("error for 01004.png is %q, want a 404", failed["01004.png"])
+	}
+	if app.cache.Exists(filepath.Join(cacheImageFolder, "01004.png")) {
+		t.Error("missing image was cached")
+	}
+	if _, ok := app.manifest.checkImage("01001.png"); !ok {
+		t.Error("01001.png was not cached")
+	}
+}
+
+func TestFetchImagesConcurrently(t *testing.T) {
+	const n = 8
+	files := make(map[string][]byte)
+	var deck []XMLCard
+	for i := 1; i <= n; i++ {
+		name := fmt.Sprintf("010%02d.png", i)
+		files["/bundles/cards/"+name] = []byte("image " + name)
+		deck = append(deck, XMLCard{Card: name, ImagePath: name})
+	}
+	site := newFakeSite(files)
+	defer site.Close()
+
+	// No request is answered until all of them have arrived, so the
+	// downloads must be running at the same time.
+	var arrived sync.WaitGroup
+	arrived.Add(n)
+	allArrived := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(allArrived)
+	}()
+	site.handle = func(string) {
+		arrived.Done()
+		select {
+		case <-allArrived:
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	app, cleanup := newTestApp(t, site.URL)
+	defer cleanup()
+	failed, err := app.fetchImages(deck)
+	if err != nil || len(failed) > 0 {
+		t.Fatalf("fetchImages: %v %v", failed, err)
+	}
+	select {
+	case <-allArrived:
+	default:
+		t.Fatal("images were not downloaded concurrently")
+	}
+	for _, card := range deck {
+		data, err := ioutil.ReadFile(imageFile(app.cache, card))
+		if err != nil || string(data) != "image "+card.ImagePath {
+			t.Errorf("cached %s is %q, error %v", card.ImagePath, data, err)
+		}
+		if _, ok := app.manifest.imageFetched(card.ImagePath); !ok {
+			t.Errorf("no fetch time recorded for %s", card.ImagePath)
+		}
+	}
+}
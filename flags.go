@@ -0,0 +1,178 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// optionalString is a string flag whose value may be omitted, as in
+// "--flag" rather than "--flag=value", in which case it takes a default.
+type optionalString struct {
+	value *string
+	def   string
+}
+
+func (o optionalString) String() string {
+	if o.value == nil {
+		return ""
+	}
+	return *o.value
+}
+
+func (o optionalString) Set(s string) error {
+	switch s {
+	case "true":
+		*o.value = o.def
+	case "false":
+		*o.value = ""
+	default:
+		*o.value = s
+	}
+	return nil
+}
+
+// IsBoolFlag lets the flag package accept the flag without a value.
+func (o optionalString) IsBoolFlag() bool {
+	return true
+}
+
+// hexColor is an RGB color flag given as six hex digits, with or without a
+// leading "#", such as "#1a2b3c".
+type hexColor struct {
+	R, G, B int
+}
+
+func (c *hexColor) String() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func (c *hexColor) Set(s string) error {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 {
+		return fmt.Errorf("color %q is not six hex digits", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return fmt.Errorf("color %q is not six hex digits", s)
+	}
+	c.R, c.G, c.B = int(v>>16), int(v>>8&0xff), int(v&0xff)
+	return nil
+}
+
+// byteSize is a size flag given in bytes or with a KB, MB or GB suffix, such
+// as "500MB".  Units are powers of 1024.
+type byteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   byteSize
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func (b *byteSize) String() string {
+	for _, u := range byteSizeUnits {
+		if *b != 0 && *b%u.size == 0 {
+			return fmt.Sprintf("%d%s", *b/u.size, u.suffix)
+		}
+	}
+	return "0"
+}
+
+func (b *byteSize) Set(s string) error {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	unit := byteSize(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(upper, u.suffix) {
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, u.suffix))
+			unit = u.size
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(upper, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("size %q is not a number of bytes, KB, MB or GB", s)
+	}
+	*b = byteSize(v * float64(unit))
+	return nil
+}
+
+// offset is a flag giving a distance in millimeters across and down the
+// page, as two comma-separated numbers such as "1.5,-0.5".
+type offset struct {
+	X, Y float64
+}
+
+func (o *offset) String() string {
+	return fmt.Sprintf("%g,%g", o.X, o.Y)
+}
+
+func (o *offset) Set(s string) error {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return fmt.Errorf("offset %q is not two comma-separated numbers", s)
+	}
+	x, errX := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	y, errY := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if errX != nil || errY != nil {
+		return fmt.Errorf("offset %q is not two comma-separated numbers", s)
+	}
+	o.X, o.Y = x, y
+	return nil
+}
+
+// stringList is a flag that may be repeated, collecting each value in
+// order.
+type stringList struct {
+	values *[]string
+}
+
+func (sl stringList) String() string {
+	if sl.values == nil {
+		return ""
+	}
+	return strings.Join(*sl.values, ", ")
+}
+
+func (sl stringList) Set(s string) error {
+	*sl.values = append(*sl.values, s)
+	return nil
+}
+
+// flagAliases maps each flag that is another name for an option to the
+// option's main flag.
+var flagAliases = map[string]string{
+	"o":             "output",
+	"output-format": "format",
+}
+
+// canonicalFlag returns the main flag of the option a flag sets.
+func canonicalFlag(name string) string {
+	if main, ok := flagAliases[name]; ok {
+		return main
+	}
+	return name
+}
+
+// flagWasSet reports whether the named option was given on the command
+// line, under any of its flags.
+func flagWasSet(name string) bool {
+	found := false
+	flag.Visit(func(f *flag.Flag) {
+		if canonicalFlag(f.Name) == canonicalFlag(name) {
+			found = true
+		}
+	})
+	return found
+}
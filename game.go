@@ -0,0 +1,136 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+const marvelURLGetAll = "https://marvelcdb.com/api/public/cards/"
+const marvelURL = "https://marvelcdb.com"
+
+const defaultGame = "lotr"
+
+// Game describes the card database of a game with OCTGN decks.  The card
+// size is the same for all supported games.
+type Game struct {
+	APIURL      string // metadata for all cards
+	SiteURL     string
+	ImagePrefix string // path of card images on the site
+	CacheName   string // per-game cache directory name
+	HallOfBeorn bool   // whether Hall of Beorn has images for the game
+	CardURL     string // card pages, each at this plus the card's code
+
+	// decode parses the API's card list.
+	decode func(body []byte) ([]RingsCard, error)
+}
+
+var games = map[string]Game{
+	"lotr": {
+		APIURL:      ringsURLGetAll,
+		SiteURL:     ringsURL,
+		ImagePrefix: ringsImagePrefix,
+		CacheName:   appConfigName,
+		HallOfBeorn: true,
+		CardURL:     "https://ringsdb.com/card/",
+		decode:      decodeRingsCards,
+	},
+	"marvel": {
+		APIURL:      marvelURLGetAll,
+		SiteURL:     marvelURL,
+		ImagePrefix: "/bundles/cards/",
+		CacheName:   appConfigName + "-marvel",
+		CardURL:     marvelURL + "/card/",
+		decode:      decodeMarvelCards,
+	},
+}
+
+func gameNames() []string {
+	names := make([]string, 0, len(games))
+	for k := range games {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithURLs returns a copy of the game using any of the given card database
+// addresses that aren't empty, such as for a mirror.  Since a mirror may not
+// have the same data, the cache name gets a hash of the addresses in use.
+func (g Game) WithURLs(apiURL, siteURL, imagePrefix string) Game {
+	if apiURL == "" && siteURL == "" && imagePrefix == "" {
+		return g
+	}
+	if apiURL != "" {
+		g.APIURL = withScheme(apiURL)
+	}
+	if siteURL != "" {
+		g.SiteURL = strings.TrimRight(withScheme(siteURL), "/")
+	}
+	if imagePrefix != "" {
+		g.ImagePrefix = "/" + strings.Trim(imagePrefix, "/") + "/"
+	}
+	sum := sha1.Sum([]byte(g.APIURL + "\n" + g.SiteURL + g.ImagePrefix))
+	g.CacheName += "-" + hex.EncodeToString(sum[:4])
+	return g
+}
+
+// withScheme adds http:// to a URL without a scheme.
+func withScheme(u string) string {
+	u = strings.TrimSpace(u)
+	if !strings.Contains(u, "://") {
+		return "http://" + u
+	}
+	return u
+}
+
+// metadataURL is the API address of card metadata in a language.
+func (g Game) metadataURL(lang string) string {
+	if lang == "" {
+		return g.APIURL
+	}
+	return g.APIURL + "?_locale=" + lang
+}
+
+func decodeRingsCards(body []byte) ([]RingsCard, error) {
+	var cardList []RingsCard
+	err := json.Unmarshal(body, &cardList)
+	return cardList, err
+}
+
+// MarvelCard is a card record from marvelcdb.com.
+type MarvelCard struct {
+	ID       string   `json:"octgn_id"`
+	Code     string   `json:"code"`
+	Name     string   `json:"name"`
+	ImageSrc string   `json:"imagesrc"`
+	Cost     cardCost `json:"cost"`
+	Sphere   string   `json:"faction_name"`
+	Type     string   `json:"type_name"`
+	PackCode string   `json:"pack_code"`
+	PackName string   `json:"pack_name"`
+
+	EncounterSet string `json:"card_set_name"`
+	Quantity     int    `json:"quantity"`
+}
+
+func decodeMarvelCards(body []byte) ([]RingsCard, error) {
+	var marvelList []MarvelCard
+	err := json.Unmarshal(body, &marvelList)
+	if err != nil {
+		return nil, err
+	}
+	cardList := make([]RingsCard, len(marvelList))
+	for i, v := range marvelList {
+		cardList[i] = RingsCard(v)
+	}
+	return cardList, nil
+}
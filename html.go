@@ -0,0 +1,174 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/shibukawa/configdir"
+)
+
+// htmlTemplate lays out each page of cards as a table, breaking pages when
+// printed from a browser.  Card sizes are in millimeters, as in the PDF.
+var htmlTemplate = template.Must(template.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+table { border-collapse: separate; border-spacing: {{.Gutter}}mm; }
+table + table { page-break-before: always; }
+td { padding: 0; vertical-align: top; text-align: center; }
+img { display: block; width: {{.CardWidth}}mm; height: {{.CardHeight}}mm; object-fit: {{.Fit}}; }
+.name { font: 9pt sans-serif; width: {{.CardWidth}}mm; }
+</style>
+</head>
+<body>
+{{- range .Pages}}
+<table>
+{{- range .}}
+<tr>
+{{- range .}}
+<td><img src="{{.Src}}" alt="{{.Name}}">{{if $.Labels}}<div class="name">{{.Name}}</div>{{end}}</td>
+{{- end}}
+</tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`))
+
+type htmlPage struct {
+	Title      string
+	Gutter     float64
+	CardWidth  float64
+	CardHeight float64
+	Fit        string // CSS object-fit, which matches --card-image-fit
+	Labels     bool
+	Pages      [][][]htmlCard // pages of rows of cards
+}
+
+type htmlCard struct {
+	Name string
+	Src  template.URL
+}
+
+// htmlImages holds card images as data URIs for embedding in HTML.
+type htmlImages struct {
+	cache    *configdir.Config
+	readOnly bool
+	proc     ImageProcessing
+
+	// uris holds the data URI of each image, or "" if it is unusable.
+	uris    map[string]template.URL
+	skipped []string
+}
+
+// usable prepares any not-yet-seen images for the given cards and returns
+// the cards whose images are usable.
+func (hi *htmlImages) usable(cards []XMLCard) ([]XMLCard, error) {
+	usable := make([]XMLCard, 0, len(cards))
+	for _, card := range cards {
+		uri, seen := hi.uris[card.ImagePath]
+		if !seen {
+			p := prepareImage(hi.cache, hi.readOnly, hi.proc, card, ioutil.ReadFile)
+			if p.err != nil {
+				return nil, fmt.Errorf("%s: %v", card.ImagePath, p.err)
+			}
+			if p.valid {
+				uri = template.URL("data:image/" + strings.ToLower(p.opts.ImageType) + ";base64," +
+					base64.StdEncoding.EncodeToString(p.data))
+			}
+			hi.uris[card.ImagePath] = uri
+		}
+		if uri == "" {
+			hi.skipped = append(hi.skipped, card.OctgnID)
+			continue
+		}
+		usable = append(usable, card)
+	}
+	return usable, nil
+}
+
+// CreateHTML writes the deck as a self-contained web page for --format html.
+func (app *App) CreateHTML() {
+	if app.err != nil || app.format != "html" {
+		return
+	}
+	defer app.failed(stageOutput)
+
+	if len(app.deck) == 0 {
+		logInfo("no cards in the deck; will not create HTML")
+		return
+	}
+
+	if app.footer || app.render.Shadow || app.render.Stamp != "" || app.render.Back != nil || app.render.Filler != nil ||
+		app.render.BorderWidth > 0 || app.render.CutLines ||
+		app.render.CornerRadius > 0 || app.layout.Border > 0 || app.render.Watermark.Text != "" || app.summary {
+		logWarn("HTML output contains card images and --labels only; footer, card backs, summary and decorations are omitted")
+	}
+
+	images := &htmlImages{
+		cache:    app.cache,
+		readOnly: app.cacheReadOnly,
+		proc:     app.imageProc,
+		uris:     make(map[string]template.URL),
+	}
+	for _, group := range app.outputGroups() {
+		app.err = app.writeHTML(group, images)
+		if app.err != nil {
+			break
+		}
+	}
+	app.missing = append(app.missing, images.skipped...)
+}
+
+func (app *App) writeHTML(group outputGroup, images *htmlImages) error {
+	pages, err := paginate(app.expandDeck(group.deck), app.layout.CardsPerPage(), images.usable)
+	if err != nil {
+		return err
+	}
+
+	page := htmlPage{
+		Title:      group.name,
+		Gutter:     app.layout.Gutter,
+		CardWidth:  app.layout.CardWidth,
+		CardHeight: app.layout.CardHeight,
+		Fit:        app.render.ImageFit,
+		Labels:     app.labels,
+	}
+	for _, cards := range pages {
+		var rows [][]htmlCard
+		for i, card := range cards {
+			if i%app.layout.Cols == 0 {
+				rows = append(rows, nil)
+			}
+			rows[len(rows)-1] = append(rows[len(rows)-1], htmlCard{Name: card.Name, Src: images.uris[card.ImagePath]})
+		}
+		page.Pages = append(page.Pages, rows)
+	}
+
+	f, err := os.Create(group.path)
+	if err != nil {
+		return err
+	}
+	err = htmlTemplate.Execute(f, page)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write %s: %v", group.path, err)
+	}
+	imageLog(group.path).info("wrote %s", group.path)
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Values of --input-format.
+const (
+	inputAuto = "auto" // ids unless the input starts like an XML document
+	inputXML  = "o8d"  // an OCTGN deck or set.xml file
+	inputIDs  = "ids"  // a list of OCTGN IDs, as read by parseIDList
+)
+
+// Section holding the cards of an ID list.
+const idListSectionName = "Deck"
+
+var octgnIDPattern = regexp.MustCompile(`^[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}$`)
+
+// isIDList reports whether data, with --input-format auto, should be read
+// as a list of OCTGN IDs rather than as XML.
+func isIDList(data []byte) bool {
+	data = bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	return !bytes.HasPrefix(data, []byte("<"))
+}
+
+// parseIDList reads a deck from a list of OCTGN IDs, one per line, each
+// optionally followed by "xN" for N copies.  Blank lines and anything after
+// a '#' are ignored, and the copies of an ID listed more than once are
+// added up.  IDs not in cards are warned about with their line number and
+// kept, so they are reported like any other card without an image.
+func parseIDList(data []byte, name string, cards map[string]CardInfo) (XMLDeck, error) {
+	section := XMLSection{Name: idListSectionName}
+	index := make(map[string]int)
+	s := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		id := fields[0]
+		if !octgnIDPattern.MatchString(id) {
+			return XMLDeck{}, fmt.Errorf("%s:%d: %q is not an OCTGN ID", name, n, id)
+		}
+		qty := 1
+		if len(fields) > 1 {
+			var err error
+			qty, err = parseCopies(fields[1])
+			if err != nil || len(fields) > 2 {
+				return XMLDeck{}, fmt.Errorf("%s:%d: want an OCTGN ID and optionally xN copies, not %q", name, n, strings.TrimSpace(line))
+			}
+		}
+
+		if i, ok := index[id]; ok {
+			section.Cards[i].Quantity += qty
+			continue
+		}
+		if _, ok := cards[id]; !ok && len(cards) > 0 {
+			logWarn("%s:%d: unknown OCTGN ID %s", name, n, id)
+		}
+		index[id] = len(section.Cards)
+		section.Cards = append(section.Cards, XMLCard{Card: id, Quantity: qty, OctgnID: id})
+	}
+	if err := s.Err(); err != nil {
+		return XMLDeck{}, fmt.Errorf("%s: %v", name, err)
+	}
+	return XMLDeck{Sections: []XMLSection{section}}, nil
+}
+
+// parseCopies parses a number of copies written like "x3".
+func parseCopies(s string) (int, error) {
+	if len(s) < 2 || (s[0] != 'x' && s[0] != 'X') {
+		return 0, fmt.Errorf("bad number of copies %q", s)
+	}
+	n, err := strconv.Atoi(s[1:])
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("bad number of copies %q", s)
+	}
+	return n, nil
+}
@@ -0,0 +1,316 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+const defaultJPEGQuality = 85
+
+// JPEG quality used by --draft unless --jpeg-quality is given.
+const draftJPEGQuality = 60
+
+const mmPerInch = 25.4
+
+const defaultFoilOpacity = 48
+
+// Largest relative difference between the aspect ratio of an image and its
+// card slot that passes without a warning.
+const maxAspectDeviation = 0.03
+
+// ImageProcessing controls transformations applied to the in-memory copy of
+// each card image before it is embedded in the PDF.  Cached files are never
+// modified.
+type ImageProcessing struct {
+	Compress    bool
+	JPEGQuality int
+
+	// MaxDPI limits image resolution at the printed card size; MaxWidth
+	// and MaxHeight are the corresponding pixel limits.
+	MaxDPI    int
+	MaxWidth  int
+	MaxHeight int
+
+	// Brightness shifts each color channel by a percentage of full scale,
+	// from -100 to 100, after Gamma correction; a Gamma above 1 lightens
+	// midtones and below 1 darkens them.
+	Brightness int
+	Gamma      float64
+
+	// Grayscale converts images to shades of gray to save ink.
+	Grayscale bool
+
+	// Foil overlays a translucent diagonal rainbow on each image.
+	Foil        bool
+	FoilOpacity int
+
+	// StripEXIF re-encodes JPEG images, which drops EXIF and other
+	// metadata segments.
+	StripEXIF bool
+}
+
+// SetPrintSize computes the pixel limits for MaxDPI from the physical card
+// size in millimeters.
+func (proc *ImageProcessing) SetPrintSize(width, height float64) {
+	if proc.MaxDPI <= 0 {
+		return
+	}
+	proc.MaxWidth = int(math.Ceil(width / mmPerInch * float64(proc.MaxDPI)))
+	proc.MaxHeight = int(math.Ceil(height / mmPerInch * float64(proc.MaxDPI)))
+}
+
+func (proc ImageProcessing) enabled() bool {
+	return proc.Compress || proc.MaxDPI > 0 || proc.adjustsLevels() || proc.Grayscale || proc.Foil || proc.StripEXIF
+}
+
+func (proc ImageProcessing) adjustsLevels() bool {
+	return proc.Brightness != 0 || proc.Gamma != 1
+}
+
+// checkAspect warns if an image's aspect ratio is far from cardAspect, the
+// width over the height of a card, as for a landscape scan, a cropped image
+// or the wrong card entirely.  With strict, that is an error instead.
+// Images whose size can't be read are left to gofpdf to reject.
+func checkAspect(data []byte, cardAspect float64, strict bool, card XMLCard) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Height == 0 {
+		return nil
+	}
+	aspect := float64(cfg.Width) / float64(cfg.Height)
+	if math.Abs(aspect/cardAspect-1) <= maxAspectDeviation {
+		return nil
+	}
+	msg := fmt.Sprintf("image for %s is %dx%d pixels, which doesn't match the card's shape", card.Card, cfg.Width, cfg.Height)
+	if strict {
+		return fmt.Errorf("%s (--strict-aspect)", msg)
+	}
+	imageLog(card.ImagePath).warn("%s: %s", card.ImagePath, msg)
+	return nil
+}
+
+// processImage applies the configured transformations to an image and returns
+// the bytes and options to register with the PDF.  All transformations share
+// a single decode and encode.  If the image can't be decoded or re-encoded, or
+// no transformation applies, the original is returned unchanged.
+func processImage(data []byte, imageOpts gofpdf.ImageOptions, proc ImageProcessing, name string) ([]byte, gofpdf.ImageOptions) {
+	if !proc.enabled() {
+		return data, imageOpts
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		imageLog(name).warn("could not decode %s for processing: %v", name, err)
+		return data, imageOpts
+	}
+
+	changed := false
+	if proc.MaxDPI > 0 {
+		if w, h, ok := fitWithin(img.Bounds(), proc.MaxWidth, proc.MaxHeight); ok {
+			img = resample(img, w, h)
+			changed = true
+		}
+	}
+	if proc.adjustsLevels() {
+		img = adjustLevels(img, proc.Brightness, proc.Gamma)
+		changed = true
+	}
+	if proc.Grayscale {
+		img = toGray(img)
+		changed = true
+	}
+	if proc.Foil {
+		img = applyFoil(img, uint8(proc.FoilOpacity))
+		changed = true
+	}
+	if proc.StripEXIF && imageOpts.ImageType == "JPEG" {
+		changed = true
+	}
+
+	toJPEG := proc.Compress && imageOpts.ImageType == "PNG"
+	if !changed && !toJPEG {
+		return data, imageOpts
+	}
+
+	var buf bytes.Buffer
+	if toJPEG || imageOpts.ImageType == "JPEG" {
+		imageOpts = gofpdf.ImageOptions{ImageType: "JPEG"}
+		err = jpeg.Encode(&buf, flattenOnWhite(img), &jpeg.Options{Quality: proc.JPEGQuality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		imageLog(name).warn("could not re-encode %s: %v", name, err)
+		return data, imageOpts
+	}
+
+	return buf.Bytes(), imageOpts
+}
+
+// gifToPNG converts the first frame of a GIF image to PNG.  The palette,
+// including any transparent entry, carries over to the PNG.
+func gifToPNG(data []byte) ([]byte, error) {
+	img, err := gif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// fitWithin returns the largest size with the same aspect ratio as bounds
+// that fits within maxWidth x maxHeight.  It returns false if bounds already
+// fits.
+func fitWithin(bounds image.Rectangle, maxWidth, maxHeight int) (int, int, bool) {
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= maxWidth && h <= maxHeight {
+		return w, h, false
+	}
+	scale := math.Min(float64(maxWidth)/float64(w), float64(maxHeight)/float64(h))
+	w = int(math.Max(1, math.Round(float64(w)*scale)))
+	h = int(math.Max(1, math.Round(float64(h)*scale)))
+	return w, h, true
+}
+
+// resample scales an image to w x h pixels, averaging the source pixels
+// covered by each destination pixel.  When enlarging, each destination pixel
+// takes the nearest source pixel.
+func resample(img image.Image, w, h int) *image.RGBA {
+	src := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := sourceSpan(y, h, src.Min.Y, src.Dy())
+		for x := 0; x < w; x++ {
+			x0, x1 := sourceSpan(x, w, src.Min.X, src.Dx())
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// sourceSpan returns the range of source coordinates covered by destination
+// coordinate i of n, always at least one pixel wide.
+func sourceSpan(i, n, srcMin, srcLen int) (int, int) {
+	lo := i * srcLen / n
+	hi := (i + 1) * srcLen / n
+	if hi <= lo {
+		hi = lo + 1
+	}
+	return srcMin + lo, srcMin + hi
+}
+
+// adjustLevels applies gamma correction and then a brightness offset to each
+// color channel, clamping results to the valid range.
+func adjustLevels(img image.Image, brightness int, gamma float64) *image.NRGBA {
+	var curve [256]uint8
+	for i := range curve {
+		v := 255*math.Pow(float64(i)/255, 1/gamma) + float64(brightness)*255/100
+		curve[i] = uint8(math.Round(math.Max(0, math.Min(255, v))))
+	}
+
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		dst.Pix[i+0] = curve[dst.Pix[i+0]]
+		dst.Pix[i+1] = curve[dst.Pix[i+1]]
+		dst.Pix[i+2] = curve[dst.Pix[i+2]]
+	}
+	return dst
+}
+
+// toGray converts an image to grayscale, flattening any transparency onto
+// white first since image.Gray has no alpha channel.
+func toGray(img image.Image) *image.Gray {
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(gray, gray.Bounds(), flattenOnWhite(img), b.Min, draw.Src)
+	return gray
+}
+
+// applyFoil blends a rainbow gradient that cycles along the diagonal over the
+// image with the given opacity.  It blends straight colors, leaving alpha
+// alone, so transparent corners stay transparent.
+func applyFoil(img image.Image, opacity uint8) *image.NRGBA {
+	const cycles = 3
+
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+
+	a := uint32(opacity)
+	span := float64(b.Dx() + b.Dy())
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			hue := math.Mod(float64(x+y)/span*cycles, 1)
+			c := hueToRGB(hue)
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8((uint32(dst.Pix[i+0])*(255-a) + uint32(c.R)*a) / 255)
+			dst.Pix[i+1] = uint8((uint32(dst.Pix[i+1])*(255-a) + uint32(c.G)*a) / 255)
+			dst.Pix[i+2] = uint8((uint32(dst.Pix[i+2])*(255-a) + uint32(c.B)*a) / 255)
+		}
+	}
+	return dst
+}
+
+// hueToRGB converts a hue in [0,1) at full saturation and value to a color.
+func hueToRGB(hue float64) color.RGBA {
+	h := hue * 6
+	x := uint8(255 * (1 - math.Abs(math.Mod(h, 2)-1)))
+	switch int(h) {
+	case 0:
+		return color.RGBA{255, x, 0, 255}
+	case 1:
+		return color.RGBA{x, 255, 0, 255}
+	case 2:
+		return color.RGBA{0, 255, x, 255}
+	case 3:
+		return color.RGBA{0, x, 255, 255}
+	case 4:
+		return color.RGBA{x, 0, 255, 255}
+	default:
+		return color.RGBA{255, 0, x, 255}
+	}
+}
+
+// flattenOnWhite composites an image with transparency onto a white
+// background, since JPEG has no alpha channel.
+func flattenOnWhite(img image.Image) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flat
+}
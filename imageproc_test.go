@@ -0,0 +1,82 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestAdjustLevels(t *testing.T) {
+	tests := []struct {
+		brightness int
+		gamma      float64
+		in, want   [3]uint8 // channel values of three pixels
+	}{
+		{0, 1, [3]uint8{0, 128, 255}, [3]uint8{0, 128, 255}},
+		{10, 1, [3]uint8{0, 100, 250}, [3]uint8{26, 126, 255}},     // +25.5, clamped
+		{-20, 1, [3]uint8{30, 200, 255}, [3]uint8{0, 149, 204}},    // -51, clamped
+		{0, 2, [3]uint8{0, 64, 255}, [3]uint8{0, 128, 255}},        // lightens midtones
+		{0, 0.5, [3]uint8{0, 128, 255}, [3]uint8{0, 64, 255}},      // darkens midtones
+		{10, 2, [3]uint8{0, 64, 255}, [3]uint8{26, 153, 255}},      // gamma, then brightness
+		{-100, 1, [3]uint8{0, 128, 255}, [3]uint8{0, 0, 0}},        // all black
+		{100, 0.5, [3]uint8{0, 128, 255}, [3]uint8{255, 255, 255}}, // all white
+	}
+	for _, tt := range tests {
+		// The image doesn't start at the origin, and its alpha must be
+		// left alone.
+		img := image.NewNRGBA(image.Rect(5, 5, 8, 6))
+		for i, v := range tt.in {
+			img.SetNRGBA(5+i, 5, color.NRGBA{R: v, G: v, B: v, A: 200})
+		}
+
+		got := adjustLevels(img, tt.brightness, tt.gamma)
+		if got.Bounds() != image.Rect(0, 0, 3, 1) {
+			t.Fatalf("brightness %d, gamma %v: bounds %v", tt.brightness, tt.gamma, got.Bounds())
+		}
+		for i, want := range tt.want {
+			c := got.NRGBAAt(i, 0)
+			if c != (color.NRGBA{R: want, G: want, B: want, A: 200}) {
+				t.Errorf("brightness %d, gamma %v: %d became %v, want %d", tt.brightness, tt.gamma, tt.in[i], c, want)
+			}
+		}
+	}
+}
+
+func TestAdjustLevelsChannels(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 10, G: 100, B: 240, A: 255})
+	got := adjustLevels(img, 5, 1).NRGBAAt(0, 0)
+	want := color.NRGBA{R: 23, G: 113, B: 253, A: 255} // each +12.75
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestApplyFoilAlpha(t *testing.T) {
+	// Transparent corners, as left by --round-corners, must stay
+	// transparent, and a translucent pixel keeps its alpha.
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{})
+	img.SetNRGBA(1, 0, color.NRGBA{R: 100, G: 100, B: 100, A: 128})
+	img.SetNRGBA(2, 0, color.NRGBA{R: 100, G: 100, B: 100, A: 255})
+
+	got := applyFoil(img, 255)
+	for x, alpha := range []uint32{0, 128 * 0x101, 0xffff} {
+		r, g, b, a := got.At(x, 0).RGBA()
+		if a != alpha {
+			t.Errorf("pixel %d: alpha %#x, want %#x", x, a, alpha)
+		}
+		if r > a || g > a || b > a {
+			t.Errorf("pixel %d: color %#x,%#x,%#x exceeds alpha %#x", x, r, g, b, a)
+		}
+	}
+	if c := color.NRGBAModel.Convert(got.At(2, 0)); c == (color.NRGBA{R: 100, G: 100, B: 100, A: 255}) {
+		t.Error("opaque pixel wasn't tinted")
+	}
+}
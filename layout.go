@@ -0,0 +1,266 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Standard LOTR LCG card dimensions in millimeters.
+const cardWidth = 63.5
+const cardHeight = 88.0
+
+// Spacing between adjacent cards used by the presets, in millimeters.
+const defaultGutter = 4.0
+
+// Space reserved under each card for a name label, in millimeters.
+const labelHeight = 5.0
+
+// Smallest page margin used when a layout is recomputed, in millimeters.
+const minMargin = 4.0
+
+const defaultPageSizePreset = "us-letter"
+
+// Layout describes the page geometry and card grid.  All dimensions are in
+// millimeters.
+type Layout struct {
+	PageWidth  float64
+	PageHeight float64
+	MarginLeft float64
+	MarginTop  float64
+	Gutter     float64
+	Rows       int
+	Cols       int
+	CardWidth  float64
+	CardHeight float64
+
+	// LabelHeight is extra space reserved under each card for its name.
+	LabelHeight float64
+
+	// Border is how far a solid frame extends out from each card.
+	Border float64
+}
+
+// pageSizePresets maps preset names to complete layouts for common printing
+// scenarios.  The "us-letter" preset preserves the historical layout.
+var pageSizePresets = map[string]Layout{
+	"us-letter": {
+		PageWidth:  215.9,
+		PageHeight: 279.4,
+		MarginLeft: 8,
+		MarginTop:  4,
+		Gutter:     defaultGutter,
+		Rows:       3,
+		Cols:       3,
+		CardWidth:  cardWidth,
+		CardHeight: cardHeight,
+	},
+	"a4":          centeredLayout(210, 297, 3, 3),
+	"a5":          centeredLayout(148, 210, 2, 2),
+	"half-letter": centeredLayout(139.7, 215.9, 2, 2),
+	"index-card":  centeredLayout(76.2, 127, 1, 1),
+}
+
+// centeredLayout returns a layout for a rows x cols grid of standard cards
+// centered on a page of the given size.
+func centeredLayout(pageWidth, pageHeight float64, rows, cols int) Layout {
+	l := Layout{
+		PageWidth:  pageWidth,
+		PageHeight: pageHeight,
+		Gutter:     defaultGutter,
+		Rows:       rows,
+		Cols:       cols,
+		CardWidth:  cardWidth,
+		CardHeight: cardHeight,
+	}
+	l.MarginLeft = (pageWidth - l.GridWidth()) / 2
+	l.MarginTop = (pageHeight - l.GridHeight()) / 2
+	return l
+}
+
+func pageSizePresetNames() []string {
+	names := make([]string, 0, len(pageSizePresets))
+	for k := range pageSizePresets {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CardsPerPage is the number of card slots on a single page.
+func (l Layout) CardsPerPage() int {
+	return l.Rows * l.Cols
+}
+
+// GridWidth is the width of the card grid, excluding margins.
+func (l Layout) GridWidth() float64 {
+	return float64(l.Cols)*l.CardWidth + float64(l.Cols-1)*l.Gutter
+}
+
+// GridHeight is the height of the card grid, excluding margins.
+func (l Layout) GridHeight() float64 {
+	return float64(l.Rows)*l.cellHeight() + float64(l.Rows-1)*l.Gutter
+}
+
+// GridRect is the rectangle of the card grid on the page.
+func (l Layout) GridRect() Rect {
+	return Rect{X: l.MarginLeft, Y: l.MarginTop, W: l.GridWidth(), H: l.GridHeight()}
+}
+
+// BleedRect is the card grid plus bleed millimeters on each side, within the
+// page.
+func (l Layout) BleedRect(bleed float64) Rect {
+	return l.GridRect().Grow(bleed).Intersect(Rect{W: l.PageWidth, H: l.PageHeight})
+}
+
+// CutLines returns the positions of lines to cut the cards apart along:
+// the edges of the grid and the middle of each gutter, across and down the
+// page.
+func (l Layout) CutLines() (xs, ys []float64) {
+	grid := l.GridRect()
+	xs = append(xs, grid.X)
+	for c := 1; c < l.Cols; c++ {
+		x, _ := l.SlotPosition(0, c)
+		xs = append(xs, x-l.Gutter/2)
+	}
+	xs = append(xs, grid.X+grid.W)
+	ys = append(ys, grid.Y)
+	for r := 1; r < l.Rows; r++ {
+		_, y := l.SlotPosition(r, 0)
+		ys = append(ys, y-l.Gutter/2)
+	}
+	ys = append(ys, grid.Y+grid.H)
+	return xs, ys
+}
+
+// cellHeight is the height of a card slot including any label.
+func (l Layout) cellHeight() float64 {
+	return l.CardHeight + l.LabelHeight
+}
+
+// WithCardSize returns a copy of the layout for cards of the given size, with
+// as many rows and columns as fit on the page and the grid centered.
+func (l Layout) WithCardSize(w, h float64) Layout {
+	l.CardWidth = w
+	l.CardHeight = h
+	l.Cols = maxInt(1, int((l.PageWidth-2*minMargin+l.Gutter)/(w+l.Gutter)))
+	l.Rows = maxInt(1, int((l.PageHeight-2*minMargin+l.Gutter)/(l.cellHeight()+l.Gutter)))
+	l.MarginLeft = (l.PageWidth - l.GridWidth()) / 2
+	l.MarginTop = (l.PageHeight - l.GridHeight()) / 2
+	return l
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// WithLabelHeight returns a copy of the layout with room for a label of the
+// given height under each card.  Rows that would no longer fit on the page,
+// leaving a bottom margin as large as the top margin, are dropped.
+func (l Layout) WithLabelHeight(h float64) Layout {
+	l.LabelHeight = h
+	for l.Rows > 1 && 2*l.MarginTop+l.GridHeight() > l.PageHeight {
+		l.Rows--
+	}
+	return l
+}
+
+// WithBorder returns a copy of the layout with a frame of the given width
+// around each card.  Gutters narrower than two frames are widened so that
+// neighboring frames don't overlap, though with no gutter they simply merge.
+// Labels move below the frame.  Columns and rows that no longer fit are
+// dropped and the grid is centered again.
+func (l Layout) WithBorder(b float64) Layout {
+	l.Border = b
+	if l.LabelHeight > 0 {
+		l = l.WithLabelHeight(l.LabelHeight + b)
+	}
+	if l.Gutter > 0 && l.Gutter < 2*b {
+		l.Gutter = 2 * b
+		for l.Cols > 1 && l.GridWidth()+2*minMargin > l.PageWidth {
+			l.Cols--
+		}
+		for l.Rows > 1 && l.GridHeight()+2*minMargin > l.PageHeight {
+			l.Rows--
+		}
+		l.MarginLeft = (l.PageWidth - l.GridWidth()) / 2
+		l.MarginTop = (l.PageHeight - l.GridHeight()) / 2
+	}
+	return l
+}
+
+// Rect is a rectangle on the page in millimeters.
+type Rect struct {
+	X, Y, W, H float64
+}
+
+// Grow returns r extended by d on every side.
+func (r Rect) Grow(d float64) Rect {
+	return Rect{X: r.X - d, Y: r.Y - d, W: r.W + 2*d, H: r.H + 2*d}
+}
+
+// Slots returns the card rectangles of a page in fill order: left to right,
+// then top to bottom.  Labels, if any, go directly below each rectangle.
+func (l Layout) Slots() []Rect {
+	slots := make([]Rect, 0, l.CardsPerPage())
+	for i := 0; i < l.Rows; i++ {
+		for j := 0; j < l.Cols; j++ {
+			x, y := l.SlotPosition(i, j)
+			slots = append(slots, Rect{X: x, Y: y, W: l.CardWidth, H: l.CardHeight})
+		}
+	}
+	return slots
+}
+
+// SlotPosition returns the top-left corner of the card slot at the given row
+// and column.
+func (l Layout) SlotPosition(row, col int) (x, y float64) {
+	x = l.MarginLeft + float64(col)*(l.CardWidth+l.Gutter)
+	y = l.MarginTop + float64(row)*(l.cellHeight()+l.Gutter)
+	return x, y
+}
+
+// Ways of scaling a card image into its slot, for --card-image-fit.
+const (
+	fitFill    = "fill"    // stretch to the slot
+	fitContain = "contain" // keep the aspect ratio, leaving blank space
+	fitCover   = "cover"   // keep the aspect ratio, cropping the overflow
+)
+
+// Fit returns where to draw an image of the given size, or aspect ratio, so
+// it fits the rectangle as fit says.  For fitCover the result extends past
+// the rectangle, and the image must be clipped to it.
+func (r Rect) Fit(w, h float64, fit string) Rect {
+	if fit == fitFill || w <= 0 || h <= 0 {
+		return r
+	}
+	scale := math.Min(r.W/w, r.H/h)
+	if fit == fitCover {
+		scale = math.Max(r.W/w, r.H/h)
+	}
+	w, h = w*scale, h*scale
+	return Rect{X: r.X + (r.W-w)/2, Y: r.Y + (r.H-h)/2, W: w, H: h}
+}
+
+// Intersect returns the part of r that is also in s.
+func (r Rect) Intersect(s Rect) Rect {
+	x, y := math.Max(r.X, s.X), math.Max(r.Y, s.Y)
+	w := math.Min(r.X+r.W, s.X+s.W) - x
+	h := math.Min(r.Y+r.H, s.Y+s.H) - y
+	return Rect{X: x, Y: y, W: math.Max(w, 0), H: math.Max(h, 0)}
+}
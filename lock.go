@@ -0,0 +1,94 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/shibukawa/configdir"
+)
+
+// Locking of the cache against other runs using it at the same time.
+const (
+	cacheLockName = "cache.lock"
+	// A lock held longer than cacheLockStale was left by a run that died.
+	// Runs hold the lock only while writing a file or two.
+	cacheLockStale = time.Minute
+	cacheLockPoll  = 20 * time.Millisecond
+)
+
+// lockCache takes the cache's lock, waiting while another run holds it, and
+// returns a function that releases it.  The lock is a file created only if
+// it doesn't exist, which works alike on every platform, holding the ID of
+// the process that owns it.  A stale lock is broken rather than waited on
+// forever.
+func lockCache(cache *configdir.Config) (func(), error) {
+	path := filepath.Join(cache.Path, cacheLockName)
+	owner := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(owner)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				_ = os.Remove(path)
+				return nil, fmt.Errorf("could not lock the cache: %v", err)
+			}
+			return func() { unlockCache(path, owner) }, nil
+		}
+
+		// On Windows a lock file being removed can't be opened for a
+		// moment, so that is waited out like a lock that is held.
+		fi, statErr := os.Stat(path)
+		if !os.IsExist(err) && !(os.IsPermission(err) && statErr == nil) {
+			return nil, fmt.Errorf("could not lock the cache: %v", err)
+		}
+		if statErr == nil && time.Since(fi.ModTime()) > cacheLockStale {
+			breakStaleLock(path, fi)
+			continue
+		}
+		time.Sleep(cacheLockPoll)
+	}
+}
+
+// breakStaleLock removes the lock file at path, which was found stale as
+// fi.  Other runs may find it stale at the same time, so it is first renamed
+// to a name only this run uses, which only one run can do.  A run that finds
+// it has renamed a newer lock instead, taken by a run that broke the stale
+// one first, puts it back, unless yet another run has taken the lock since.
+func breakStaleLock(path string, fi os.FileInfo) {
+	moved := fmt.Sprintf("%s.%d-%d.stale", path, os.Getpid(), time.Now().UnixNano())
+	if os.Rename(path, moved) != nil {
+		return
+	}
+	movedFi, err := os.Stat(moved)
+	if err != nil || !os.SameFile(fi, movedFi) || !movedFi.ModTime().Equal(fi.ModTime()) {
+		_ = os.Link(moved, path)
+		_ = os.Remove(moved)
+		return
+	}
+	holder, _ := ioutil.ReadFile(moved)
+	logWarn("removing a stale cache lock left by process %s", bytes.TrimSpace(holder))
+	_ = os.Remove(moved)
+}
+
+// unlockCache removes the lock file, unless another run has broken the
+// lock as stale and taken it since.
+func unlockCache(path string, owner []byte) {
+	holder, err := ioutil.ReadFile(path)
+	if err == nil && bytes.Equal(holder, owner) {
+		_ = os.Remove(path)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// staleLock writes a lock file held by a process that died long ago.
+func staleLock(t *testing.T, path string) os.FileInfo {
+	err := ioutil.WriteFile(path, []byte("99999\n"), 0644)
+	old := time.Now().Add(-2 * cacheLockStale)
+	if err == nil {
+		err = os.Chtimes(path, old, old)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi
+}
+
+func TestLockCacheBreaksStaleLock(t *testing.T) {
+	cache, _, cleanup := newTestCache(t)
+	defer cleanup()
+	path := filepath.Join(cache.Path, cacheLockName)
+	staleLock(t, path)
+
+	unlock, err := lockCache(cache)
+	if err != nil {
+		t.Fatalf("lockCache: %v", err)
+	}
+	holder, err := ioutil.ReadFile(path)
+	if err != nil || string(holder) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Errorf("lock held by %q, error %v", holder, err)
+	}
+	unlock()
+	if cache.Exists(cacheLockName) {
+		t.Error("lock not released")
+	}
+	if stale, _ := filepath.Glob(path + ".*"); len(stale) > 0 {
+		t.Errorf("files left: %v", stale)
+	}
+}
+
+func TestBreakStaleLockKeepsNewerLock(t *testing.T) {
+	cache, _, cleanup := newTestCache(t)
+	defer cleanup()
+	path := filepath.Join(cache.Path, cacheLockName)
+
+	// This run found the lock stale, but another run broke it and took
+	// the lock before this one got to it.
+	fi := staleLock(t, path)
+	err := os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockCache(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	breakStaleLock(path, fi)
+	holder, err := ioutil.ReadFile(path)
+	if err != nil || string(holder) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Errorf("newer lock was broken: holder %q, error %v", holder, err)
+	}
+	if stale, _ := filepath.Glob(path + ".*"); len(stale) > 0 {
+		t.Errorf("files left: %v", stale)
+	}
+}
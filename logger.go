@@ -0,0 +1,150 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// logLevel selects how much progress logging is written to stderr.  Fatal
+// errors bypass it and are always written, via fatalf.
+type logLevel int
+
+const (
+	levelQuiet   logLevel = iota // nothing but fatal errors
+	levelNormal                  // progress and warnings
+	levelVerbose                 // also requests, cache paths and timings
+)
+
+var verbosity = levelNormal
+
+// jsonLogs selects one JSON object per line instead of plain text.
+var jsonLogs = false
+
+// logStage holds the name of the pipeline stage running, for JSON logs.
+// Server handlers and background work log while timeStage changes it, so
+// it is a string in an atomic.Value.
+var logStage atomic.Value
+
+func currentLogStage() string {
+	stage, _ := logStage.Load().(string)
+	return stage
+}
+
+// logFields are optional details of a log message.  In plain text logs they
+// are left out, since messages already mention them.
+type logFields struct {
+	Image string
+	Count int
+
+	hasCount bool
+}
+
+// logRecord is the form of a JSON log line.
+type logRecord struct {
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+	Stage string `json:"stage,omitempty"`
+	Image string `json:"image,omitempty"`
+	Count *int   `json:"count,omitempty"`
+}
+
+func imageLog(image string) logFields {
+	return logFields{Image: image}
+}
+
+func countLog(n int) logFields {
+	return logFields{Count: n, hasCount: true}
+}
+
+// logInfo logs progress at the normal level.
+func logInfo(format string, args ...interface{}) {
+	logFields{}.info(format, args...)
+}
+
+// logWarn logs a problem that doesn't stop the run at the normal level.
+func logWarn(format string, args ...interface{}) {
+	logFields{}.warn(format, args...)
+}
+
+// logDebug logs details at the verbose level.
+func logDebug(format string, args ...interface{}) {
+	logFields{}.debug(format, args...)
+}
+
+func (f logFields) info(format string, args ...interface{}) {
+	if verbosity >= levelNormal {
+		f.output("info", "", format, args...)
+	}
+}
+
+func (f logFields) warn(format string, args ...interface{}) {
+	if verbosity >= levelNormal {
+		f.output("warning", "warning: ", format, args...)
+	}
+}
+
+func (f logFields) debug(format string, args ...interface{}) {
+	if verbosity >= levelVerbose {
+		f.output("debug", "", format, args...)
+	}
+}
+
+func (f logFields) output(level string, prefix string, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !jsonLogs {
+		log.Print(prefix + msg)
+		return
+	}
+	rec := logRecord{Level: level, Msg: msg, Stage: currentLogStage(), Image: f.Image}
+	if f.hasCount {
+		rec.Count = &f.Count
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Print(prefix + msg)
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(line))
+}
+
+// fatalf logs an error, whatever the verbosity, and exits with
+// exitFailure.
+func fatalf(format string, args ...interface{}) {
+	exitf(exitFailure, format, args...)
+}
+
+// usagef logs a command line error, whatever the verbosity, and exits with
+// exitUsage.
+func usagef(format string, args ...interface{}) {
+	exitf(exitUsage, format, args...)
+}
+
+// exitf logs an error, whatever the verbosity, and exits with code.
+func exitf(code int, format string, args ...interface{}) {
+	if jsonLogs {
+		logFields{}.output("error", "", format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+	os.Exit(code)
+}
+
+// timeStage runs a pipeline stage, logging how long it took at the verbose
+// level.
+func timeStage(name string, stage func()) {
+	logStage.Store(name)
+	start := time.Now()
+	stage()
+	logDebug("%s stage took %v", name, time.Since(start).Round(time.Millisecond))
+	logStage.Store("")
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestLogStageConcurrent logs from another goroutine, as a server handler
+// does, while stages run.  Run with -race.
+func TestLogStageConcurrent(t *testing.T) {
+	out, err := ioutil.TempFile("", "lotrproxypdf-log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	stderr := os.Stderr
+	os.Stderr = out
+	verbosity, jsonLogs = levelNormal, true
+	defer func() {
+		os.Stderr = stderr
+		verbosity, jsonLogs = levelQuiet, false
+	}()
+
+	var wg sync.WaitGroup
+	started, done := make(chan struct{}), make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		close(started)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				logInfo("handling a request")
+			}
+		}
+	}()
+	<-started
+	for i := 0; i < 100; i++ {
+		timeStage("parse", func() { logInfo("parsing") })
+	}
+	close(done)
+	wg.Wait()
+
+	_, err = out.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := bufio.NewScanner(out)
+	for s.Scan() {
+		var rec logRecord
+		err := json.Unmarshal(s.Bytes(), &rec)
+		if err != nil {
+			t.Fatalf("bad log line %q: %v", s.Text(), err)
+		}
+		if rec.Msg == "parsing" && rec.Stage != "parse" {
+			t.Fatalf("stage of %q is %q", rec.Msg, rec.Stage)
+		}
+		if rec.Stage != "" && rec.Stage != "parse" {
+			t.Fatalf("unknown stage %q", rec.Stage)
+		}
+	}
+	if currentLogStage() != "" {
+		t.Errorf("stage %q left set", currentLogStage())
+	}
+}
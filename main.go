@@ -7,20 +7,32 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
-	"encoding/xml"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/jung-kurt/gofpdf"
 	"github.com/shibukawa/configdir"
@@ -28,36 +40,205 @@ import (
 
 const vendorName = "xdg.me"
 const appConfigName = "cardproxypdf"
-const cacheDBName = "carddb.json"
+const cacheDBName = "carddb"
 const cacheImageFolder = "images"
 const ringsURLGetAll = "http://ringsdb.com/api/public/cards/"
 const ringsURL = "http://ringsdb.com"
 const ringsImagePrefix = "/bundles/cards/"
+const hallOfBeornURL = "https://s3.amazonaws.com/hallofbeorn-resources/Images/Cards/"
+const hallOfBeornFolder = "hallofbeorn"
+const stdinInput = "-" // input file name to read the deck from standard input
+const defaultHTTPTimeout = 60 * time.Second
+const defaultImageTimeout = 10 * time.Second
+const remotePutTimeout = 5 * time.Second
+
+// userAgent identifies lotrproxypdf to the servers it downloads from.
+func userAgent() string {
+	return "cardproxypdf/" + version + " (+https://github.com/xdg-go/lotrproxypdf)"
+}
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
 
 var errIgnoreCache = errors.New("cache missing or out of date")
 
+// Cached metadata older than this is refreshed.
+const metadataMaxAge = 24 * time.Hour
+
+// When stale cached metadata is refreshed, for --metadata-update-strategy.
+const (
+	updateEager = "eager" // before this run uses it
+	updateLazy  = "lazy"  // in the background, for the next run
+)
+
 type App struct {
 	// command line
-	inputFile  string
-	outputFile string
+	inputFile      string
+	inputFormat    string
+	outputFile     string
+	outputDir      string // where to write a file named after the deck
+	overwrite      bool
+	usedOutputs    map[string]bool // written by this batch run
+	watch          bool
+	listen         string
+	prewarmDeck    string
+	pageSizePreset string
+	border         float64
+	apiFallbackURL string
+	inputJSONPath  string
+	schemaVersion  int
+	footer         bool
+	maxNameLength  int
+	labels         bool
+	render         RenderOptions
+	imageProc      ImageProcessing
+	draft          bool
+	remoteCache    string
+	cacheDir       string
+	apiCacheKey    string
+	cacheReadOnly  bool
+	cacheMaxSize   byteSize
+	imageCacheTTL  time.Duration
+	imageSources   imageSources
+	sourceList     string
+	lang           string
+	gameName       string
+	dbURL          string
+	imageBaseURL   string
+	imagePrefix    string
+	renderOrder    []string
+	sortBy         string
+	includeExtras  bool
+	skipSections   *regexp.Regexp
+	ownedFile      string
+	encounterSets  []string
+	cardSpecs      []cardSpec
+	packsOwned     map[string]bool // lowercased pack codes
+	listPacks      bool
+	expandEarly    bool
+	httpTimeout    time.Duration
+	rateLimit      float64
+	imageTimeout   time.Duration
+	missingReport  string
+	format         string
+	grouping       string
+	splitBySection bool
+	sectionsDir    string
+	zipOutput      bool
+	pdfInfoDump    bool
+	tocJSON        bool
+	cardInfoJSON   string
+	pdfCreator     string
+	reproducible   bool
+	buildTime      time.Time // date written into outputs
+	noImageDedup   bool
+	strictAspect   bool
+	imagesDir      string
+	cardBacks      bool
+	cardBackURL    string
+	fillEmpty      string
+	links          bool
+	summary        bool
+	cardPrintDPI   int
+	cardWidthPx    int
+	cardHeightPx   int
+	splitEvery     int
+	copies         int
+	collate        bool
+	asyncSave      bool
+	metadataUpdate string
+	pngDPI         int
+	timeout        time.Duration
+	nonInteractive bool
 
 	// app-wide data
-	cache *configdir.Config
-	err   error
+	ctx        context.Context // cancelled on interrupt or --timeout
+	cache      *configdir.Config
+	manifest   *cacheManifest
+	fetch      *fetcher // makes every HTTP request
+	err        error
+	asyncSaves *sync.WaitGroup
+	outputDone chan struct{} // closed once output is written
+
+	// stdinReader is shared by prompts; see stdin.
+	stdinReader *bufio.Reader
+	// nameChoices holds the OCTGN ID chosen for each ambiguous card name.
+	nameChoices map[string]string
+
+	// derived from command line
+	game        Game
+	layout      Layout
+	interactive bool // prompts may be answered on stdin
 
 	// pipeline stage outputs
-	deck           []XMLCard
-	octgnToImgName map[string]string
+	deck        []XMLCard
+	octgnToCard map[string]CardInfo
+	missing     []string // OCTGN IDs of skipped cards
+}
+
+// RenderOptions controls how each card is drawn on the page.
+type RenderOptions struct {
+	Shadow     bool
+	Stamp      string // printed in the right margin if not empty
+	LabelColor hexColor
+	FontScale  float64 // multiplies the size of all text
+	ImageFit   string  // how images are scaled into slots; see Rect.Fit
+
+	// BorderWidth, if positive, is the stroke in millimeters of a border of
+	// BorderColor around each card image.
+	BorderWidth float64
+	BorderColor hexColor
+
+	// CutLines draws lines across the page between cards.  With Bleed, the
+	// millimeters of --page-bleed-box, they stop short of the bleed box.
+	CutLines bool
+	Bleed    float64
+
+	// CornerRadius, if positive, rounds the corners of card images by
+	// clipping them, in millimeters.
+	CornerRadius float64
+
+	// FrameColor fills the frame of Layout.Border around each card.
+	FrameColor hexColor
+
+	Watermark Watermark
+
+	// LinkBase, if set, links each card image to LinkBase followed by the
+	// card's code.
+	LinkBase string
+
+	// Back, if set, is printed on a page after each page of fronts.
+	Back *XMLCard
+
+	// Filler, if set, is drawn in the slots a page of fronts leaves empty,
+	// and its back page has a full page of backs.
+	Filler *XMLCard
+
+	// BackOffset shifts the cards of back pages to make up for a printer
+	// that doesn't line up the two sides of a sheet.
+	BackOffset offset
 }
 
 type XMLCard struct {
 	Card      string `xml:",chardata"`
 	Quantity  int    `xml:"qty,attr"`
 	OctgnID   string `xml:"id,attr"`
+	Name      string // filled in later from metadata
 	ImagePath string // filled in later from metadata
+	Section   string // filled in later from the enclosing section
+	Cost      string // filled in later from metadata
+	Sphere    string // filled in later from metadata
+	Type      string // filled in later from metadata
+	Pack      string // filled in later from metadata
+	Code      string // filled in later from metadata
+
+	// Override is set if ImagePath is the full path of a file from the
+	// --images-dir directory rather than a path in the image cache.
+	Override bool
 }
 
 type XMLSection struct {
+	Name  string    `xml:"name,attr"`
 	Cards []XMLCard `xml:"card"`
 }
 
@@ -65,142 +246,887 @@ type XMLDeck struct {
 	Sections []XMLSection `xml:"section"`
 }
 
+// CardInfo is the per-card metadata kept in the cache, keyed by OCTGN ID.
+type CardInfo struct {
+	Name   string `json:"name"`
+	Code   string `json:"code,omitempty"` // on the game's card database
+	Image  string `json:"image"`
+	Cost   string `json:"cost,omitempty"`
+	Sphere string `json:"sphere,omitempty"`
+	Type   string `json:"type,omitempty"`
+
+	Pack     string `json:"pack,omitempty"` // pack code
+	PackName string `json:"pack_name,omitempty"`
+
+	EncounterSet string `json:"encounter_set,omitempty"`
+	Quantity     int    `json:"quantity,omitempty"` // copies in its pack
+}
+
 type RingsCard struct {
-	ID       string `json:"octgnid"`
-	ImageSrc string `json:"imagesrc"`
+	ID       string   `json:"octgnid"`
+	Code     string   `json:"code"`
+	Name     string   `json:"name"`
+	ImageSrc string   `json:"imagesrc"`
+	Cost     cardCost `json:"cost"`
+	Sphere   string   `json:"sphere_name"`
+	Type     string   `json:"type_name"`
+	PackCode string   `json:"pack_code"`
+	PackName string   `json:"pack_name"`
+
+	EncounterSet string `json:"encounter_set"`
+	Quantity     int    `json:"quantity"`
+}
+
+// cardCost is a card's cost, which the APIs give as a number, a string such
+// as "X", or null.
+type cardCost string
+
+func (c *cardCost) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		*c = cardCost(v)
+	case float64:
+		*c = cardCost(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		*c = ""
+	}
+	return nil
 }
 
 func main() {
-	// Check for correct usage
-	if len(os.Args) != 3 {
-		log.Fatalf("usage: %s <input.o8d> <output.pdf>", os.Args[0])
+	app := &App{asyncSaves: &sync.WaitGroup{}}
+
+	var showVersion, quiet, verbose bool
+	var logFormat string
+	var skipSections string
+	var packsOwned string
+	var cardNames []string
+	flag.BoolVar(&showVersion, "version", false, "print the version and exit")
+	flag.BoolVar(&quiet, "quiet", false, "log nothing but fatal errors")
+	flag.BoolVar(&verbose, "verbose", false, "also log each request, cache paths and stage timings")
+	flag.StringVar(&logFormat, "log-format", "text", "log `format`: text, or json for one object per line")
+	flag.StringVar(&app.outputFile, "output", "", "write to `file`; the input deck is then the only argument")
+	flag.StringVar(&app.outputFile, "o", "", "shorthand for --output")
+	flag.StringVar(&app.outputDir, "output-dir", "",
+		"write to a file in `dir` named after the input deck, as when the output file is a directory")
+	flag.BoolVar(&app.watch, "watch", false,
+		"keep running, and write the output again each time the input file changes")
+	flag.StringVar(&app.listen, "listen", ":8080", "`address` for the serve subcommand to listen on")
+	flag.StringVar(&app.prewarmDeck, "cache-prewarm-on-start", "",
+		"with serve, fetch the images of the cards in `deck` before listening, so requests for it don't wait on downloads")
+	flag.BoolVar(&app.overwrite, "overwrite", false,
+		"with --output-dir, replace a file of the same name rather than adding a number to the new one")
+	flag.StringVar(&app.pageSizePreset, "page-size-preset", defaultPageSizePreset,
+		"paper size, margins and grid `preset` ("+strings.Join(pageSizePresetNames(), ", ")+")")
+	flag.StringVar(&app.apiFallbackURL, "api-fallback-url", "",
+		"card metadata `url` to try if "+ringsURLGetAll+" fails")
+	flag.StringVar(&app.inputJSONPath, "input-json-path", "",
+		"dot-separated `path`, like data.deck.cards, to the card array in wrapped metadata JSON")
+	flag.BoolVar(&app.footer, "footer", false,
+		"print deck name, date and page numbers in the bottom margin")
+	flag.IntVar(&app.maxNameLength, "max-card-name-length", 200,
+		"skip API card records with names longer than `n` characters (0 for no limit)")
+	flag.IntVar(&app.cardPrintDPI, "card-print-scale", 0,
+		"set the card size in pixels with --card-width-px and --card-height-px printed at this `dpi`")
+	flag.IntVar(&app.cardWidthPx, "card-width-px", 0, "card `width` in pixels for --card-print-scale")
+	flag.IntVar(&app.cardHeightPx, "card-height-px", 0, "card `height` in pixels for --card-print-scale")
+	flag.BoolVar(&app.labels, "labels", false, "print the card name under each card")
+	flag.Var(&app.render.LabelColor, "card-name-font-color", "`hex` color of --labels text")
+	flag.Float64Var(&app.border, "border", 0,
+		"extend a solid frame `mm` wide out from each card, to hide imperfect cuts; gutters are widened to fit")
+	flag.Var(&app.render.FrameColor, "border-color", "`hex` color of the --border frame (default black)")
+	flag.Float64Var(&app.render.CornerRadius, "round-corners", 0,
+		"round the corners of card images with a radius of `mm`, leaving the corners blank, e.g. 3 (0 for square corners)")
+	flag.BoolVar(&app.render.CutLines, "cut-lines", false,
+		"draw thin lines across the page between cards, e.g. for a rotary trimmer; with --page-bleed-box only in the margins")
+	flag.Float64Var(&app.render.BorderWidth, "card-image-border-width", 0,
+		"draw a border `mm` wide around each card image (0 for none)")
+	flag.Var(&app.render.BorderColor, "card-image-border-color", "`hex` color of the card image border")
+	flag.StringVar(&app.render.Watermark.Text, "watermark-text", "",
+		"print `text`, such as \"PLAYTEST v3\", translucently across each card, shrunk to fit")
+	flag.Float64Var(&app.render.Watermark.Opacity, "watermark-opacity", defaultWatermarkOpacity,
+		"`opacity` of --watermark-text, from 0 (invisible) to 1 (solid)")
+	flag.StringVar(&app.render.Watermark.Position, "watermark-position", watermarkDiagonal,
+		"`where` to print --watermark-text: center, bottom or diagonal")
+	flag.Float64Var(&app.render.FontScale, "font-scale", 1, "multiply the size of all printed text by `factor`")
+	flag.BoolVar(&app.render.Shadow, "render-shadow", false, "draw a drop shadow beneath each card")
+	flag.StringVar(&app.render.ImageFit, "card-image-fit", fitFill,
+		"`mode` of scaling images into card slots: fill (stretch), contain (letterbox) or cover (crop)")
+	flag.BoolVar(&app.strictAspect, "strict-aspect", false,
+		"fail instead of warning when an image's aspect ratio is more than 3% off the card's")
+	stampDefault := "Generated by lotrproxypdf on " + time.Now().Format("2006-01-02")
+	flag.BoolVar(&app.summary, "summary", false,
+		"start each PDF with a deck list of every card's quantity, sphere and type by section; its pages don't count toward --split-every")
+	flag.BoolVar(&app.links, "links", false, "link each card in the PDF to its page on the card database, e.g. ringsdb.com")
+	flag.Var(optionalString{&app.render.Stamp, stampDefault},
+		"output-stamp", "print a small stamp in the right margin of each page; use --output-stamp=`text` for custom text")
+	flag.BoolVar(&app.imageProc.Compress, "compress", false, "re-encode PNG images as JPEG to shrink the PDF")
+	flag.IntVar(&app.imageProc.JPEGQuality, "jpeg-quality", defaultJPEGQuality, "JPEG `quality` (1-100) for --compress")
+	flag.IntVar(&app.imageProc.MaxDPI, "max-dpi", 0,
+		"downscale images above this `dpi` at the printed card size (0 for no limit)")
+	flag.IntVar(&app.imageProc.Brightness, "brightness", 0,
+		"lighten (positive) or darken (negative) images by this `percent` of full scale")
+	flag.Float64Var(&app.imageProc.Gamma, "gamma", 1, "`gamma` correction of images; above 1 lightens midtones")
+	flag.BoolVar(&app.imageProc.Grayscale, "grayscale", false, "convert images to grayscale to save ink")
+	flag.BoolVar(&app.draft, "draft", false,
+		"ink-saving drafts: same as --grayscale --compress with a default JPEG quality of 60")
+	flag.BoolVar(&app.imageProc.Foil, "card-foil-effect", false, "overlay a rainbow foil shimmer on each card")
+	flag.IntVar(&app.imageProc.FoilOpacity, "foil-opacity", defaultFoilOpacity, "`opacity` (0-255) of --card-foil-effect")
+	flag.BoolVar(&app.imageProc.StripEXIF, "image-exif-strip", false,
+		"re-encode JPEG images to remove EXIF metadata")
+	flag.StringVar(&app.imagesDir, "images-dir", "",
+		"use images in `dir` named <octgn-id>.jpg, <octgn-id>.png or like the cached file instead of downloading")
+	flag.BoolVar(&app.cardBacks, "card-backs", false,
+		"follow each page with a page of card backs for double-sided printing")
+	flag.StringVar(&app.cardBackURL, "card-back-image-url", "", "`url` of the card back image for --card-backs")
+	flag.StringVar(&app.fillEmpty, "fill-empty", fillBlank,
+		"`fill` the empty slots of a page: blank, back for the --card-back-image-url image, or the path of an image file")
+	flag.Var(&app.render.BackOffset, "card-back-offset",
+		"shift the cards on --card-backs pages right and down by `x,y` millimeters, e.g. 1.5,-0.5, to line up with the fronts")
+	flag.StringVar(&app.sourceList, "image-source", "ringsdb,hallofbeorn",
+		"comma-separated image `sources` to try in order: ringsdb (the --game card database), hallofbeorn")
+	flag.StringVar(&app.imageSources.HallOfBeornURL, "hallofbeorn-url", hallOfBeornURL,
+		"base `url` of Hall of Beorn card images, named after the card")
+	flag.StringVar(&app.gameName, "game", defaultGame,
+		"card `game`: "+strings.Join(gameNames(), ", "))
+	flag.StringVar(&app.dbURL, "db-url", "", "card metadata API `url` to use instead of the --game default")
+	flag.StringVar(&app.imageBaseURL, "image-base-url", "",
+		"site `url` of card images to use instead of the --game default")
+	flag.StringVar(&app.imagePrefix, "image-prefix", "",
+		"`path` of card images on the site to use instead of the --game default")
+	flag.StringVar(&app.lang, "lang", "",
+		"`language` of card images: "+strings.Join(languages, ", ")+"; English is used where no translation exists")
+	flag.StringVar(&app.cacheDir, "cache-dir", os.Getenv(cacheDirEnv),
+		"`dir` to keep card metadata and images in instead of the user cache folder (or set $"+cacheDirEnv+")")
+	flag.StringVar(&app.apiCacheKey, "api-cache-key", "",
+		"keep the cache in a subdirectory named `key`, e.g. to separate card databases; by default each --game and --db-url has its own")
+	flag.BoolVar(&app.cacheReadOnly, "image-cache-readonly", false,
+		"never write to the cache; cards whose images aren't cached are skipped")
+	flag.Var(&app.cacheMaxSize, "cache-max-size",
+		"after downloading, remove the least recently used images not in this deck until the image cache is under `size`, e.g. 500MB (0 for no limit)")
+	flag.DurationVar(&app.imageCacheTTL, "image-cache-ttl", 0,
+		"fetch cached images again once they are older than `duration`, e.g. 720h (0 to keep them until evicted)")
+	flag.StringVar(&app.remoteCache, "cache-remote-sync", "",
+		"shared HTTP image cache `url` to download from and upload to")
+	flag.StringVar(&app.inputFormat, "input-format", inputAuto,
+		"input `format`: o8d for an OCTGN deck or set.xml file, ids for lines of an OCTGN ID and optionally xN copies, or auto to tell them apart by content")
+	flag.IntVar(&app.schemaVersion, "deck-schema-version", defaultDeckSchemaVersion,
+		"OCTGN deck file schema `version`: 1 (qty attributes, as from RingsDB), 2 (count attributes) or 3 (either, and cards outside sections)")
+	flag.Float64Var(&app.rateLimit, "rate-limit", defaultRateLimit,
+		"most `requests` per second to send, spread across all downloads (0 for no limit)")
+	flag.DurationVar(&app.httpTimeout, "http-timeout", defaultHTTPTimeout,
+		"maximum `duration` to wait for a server to start responding; downloads then take as long as they need")
+	flag.DurationVar(&app.imageTimeout, "timeout-per-image", defaultImageTimeout,
+		"maximum `duration` of each image download")
+	flag.BoolVar(&app.asyncSave, "async-cache-save", false,
+		"save fetched metadata to the cache in the background")
+	flag.StringVar(&app.metadataUpdate, "metadata-update-strategy", updateEager,
+		"`strategy` for refreshing cached metadata older than a day: eager, to fetch it before use, or lazy, to use it as is and fetch it in the background for the next run")
+	flag.StringVar(&app.missingReport, "report-missing-images", "",
+		"write OCTGN IDs of cards skipped for lack of an image to `file`")
+	flag.StringVar(&app.format, "format", "pdf",
+		"output `format`: pdf, png for one image per sheet named like output-001.png, or html for a web page with the images embedded")
+	flag.StringVar(&app.format, "output-format", "pdf", "same as --format")
+	flag.IntVar(&app.pngDPI, "png-dpi", defaultPNGDPI, "`dpi` of sheets written by --format png")
+	flag.StringVar(&app.grouping, "card-grouping-strategy", "consecutive",
+		"placement of multiple copies: consecutive, or dispersed to spread copies across pages")
+	flag.StringVar(&skipSections, "skip-sections", "",
+		"leave out deck sections whose names match the regular expression `regex`, e.g. '^(Sideboard|Quest)$'")
+	flag.Var(stringList{&app.encounterSets}, "encounter-set",
+		"print every card of the encounter set `name` instead of reading a deck file; repeat to combine sets in the order given")
+	flag.Var(stringList{&cardNames}, "card",
+		"also print the card `name`, with an optional pack name or code in parentheses and :copies, e.g. \"Gandalf (Core Set):2\"; repeat for more cards, with or without a deck file")
+	flag.BoolVar(&app.nonInteractive, "non-interactive", false,
+		"never ask which card an ambiguous --card name means, even when run from a terminal")
+	flag.StringVar(&app.ownedFile, "own", "",
+		"leave out copies of cards listed in `file`, one OCTGN ID or card name per line with an optional comma and quantity owned")
+	flag.StringVar(&packsOwned, "packs-owned", "",
+		"leave out cards from packs you own, given as comma-separated pack `codes` or the name of a file listing them; see --list-packs")
+	flag.BoolVar(&app.listPacks, "list-packs", false,
+		"print the code and name of every pack in the card metadata and exit")
+	flag.BoolVar(&app.includeExtras, "include-extras", true,
+		"include the deck's Extras section, if any; use --include-extras=false to leave it out")
+	flag.BoolVar(&app.expandEarly, "expand-quantities-to-deck", false,
+		"list each copy of a card separately, with quantity 1, as soon as the deck is read")
+	flag.Var(sortKeys{&app.renderOrder}, "card-render-order",
+		"comma-separated `fields` to sort cards by within each section: "+strings.Join(sortFields, ", "))
+	flag.StringVar(&app.sortBy, "sort", sortNone,
+		"order all cards by `field`, ignoring sections: "+strings.Join(wholeDeckSortFields, ", ")+"; ties keep their order")
+	flag.BoolVar(&app.splitBySection, "split-by-section", false,
+		"write one output per deck section, named like output-Hero.pdf")
+	flag.StringVar(&app.sectionsDir, "sections-as-files", "",
+		"write each deck section to `dir`/<section>.pdf instead of a single output file")
+	flag.BoolVar(&app.zipOutput, "zip-output", false,
+		"write each PDF as proxies.pdf inside a ZIP archive named like output.pdf.zip")
+	flag.StringVar(&app.pdfCreator, "pdf-creator", "",
+		"set the Creator field of PDF document information to `text`, e.g. the name of a larger workflow")
+	flag.BoolVar(&app.pdfInfoDump, "pdf-info-dump", false,
+		"print the document information of each written PDF to stdout as JSON")
+	flag.StringVar(&app.cardInfoJSON, "card-info-json", "",
+		"write the metadata, quantity and image of each card in the deck to `file` as JSON")
+	flag.BoolVar(&app.noImageDedup, "no-image-dedup", false,
+		"register a separate PDF image for every card drawn, even copies of the same file, to debug image handling")
+	flag.BoolVar(&app.tocJSON, "generate-toc-json", false,
+		"write the page, row and column of every card in each PDF to a file named like output-toc.json")
+	flag.Float64Var(&app.render.Bleed, "page-bleed-box", 0,
+		"write trim, bleed and art boxes for professional printing, with the trim box around the card grid and `mm` of bleed beyond it (0 for none)")
+	flag.DurationVar(&app.timeout, "timeout", 0,
+		"give up the whole run, or with serve each request, after `duration`, e.g. 5m (0 for no limit, or 2m with serve)")
+	flag.IntVar(&app.copies, "copies", 1,
+		"print `n` copies of the whole deck in each PDF: each card n times in a row, or with --collate the deck's pages n times over")
+	flag.BoolVar(&app.reproducible, "reproducible", false,
+		"write identical output for identical input by pinning dates to $SOURCE_DATE_EPOCH, or to 1970-01-01 if unset")
+	flag.BoolVar(&app.collate, "collate", false,
+		"with --copies, repeat all of the deck's pages for each copy instead of repeating each card")
+	flag.IntVar(&app.splitEvery, "split-every", 0,
+		"start a new PDF, named like output-part2.pdf, after every `n` pages (0 for a single file)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [options] -o <output.pdf> <input.o8d>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [options] <input.o8d> <output.pdf>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [options] --sections-as-files <dir> <input.o8d>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [options] --encounter-set <name> <output.pdf>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [options] --card <name> <output.pdf>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [options] --list-packs\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [options] cache info|verify\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [options] config init\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Defaults for options can be set in %s.\n", configFilePath())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	batch := flag.Arg(0) == "batch"
+	serve := flag.Arg(0) == "serve"
+	var batchInputs []string
+	if batch {
+		batchInputs = parseBatchArgs(flag.Args()[1:])
+	}
+	if showVersion {
+		fmt.Printf("%s %s\n", filepath.Base(os.Args[0]), version)
+		os.Exit(exitOK)
+	}
+	// The config subcommand must work even if the config file doesn't.
+	if flag.Arg(0) == "config" {
+		os.Exit(configCommand(flag.Args()[1:]))
+	}
+	if err := applyConfigFile(configFilePath()); err != nil {
+		usagef("error: %v", err)
+	}
+	switch logFormat {
+	case "text":
+	case "json":
+		jsonLogs = true
+	default:
+		usagef("unknown log format %q", logFormat)
+	}
+	switch {
+	case quiet && verbose:
+		usagef("--quiet and --verbose can't be used together")
+	case quiet:
+		verbosity = levelQuiet
+	case verbose:
+		verbosity = levelVerbose
+	}
+
+	var ok bool
+	app.game, ok = games[app.gameName]
+	if !ok {
+		usagef("unknown game %q", app.gameName)
+	}
+	app.game = app.game.WithURLs(app.dbURL, app.imageBaseURL, app.imagePrefix)
+	if app.links {
+		app.render.LinkBase = app.game.CardURL
+	}
+	app.cache = openCache(app.cacheDir, app.game.CacheName, app.apiCacheKey)
+	var err error
+	if !app.cacheReadOnly {
+		err = app.cache.MkdirAll()
+		if err != nil {
+			fatalf("error: %v", err)
+		}
+		removeStaleTempFiles(app.cache)
+	}
+	app.manifest = openManifest(app.cache, app.cacheReadOnly)
+	app.imageSources.SiteURL = app.game.SiteURL
+	app.imageSources.ImagePrefix = app.game.ImagePrefix
+
+	if flag.Arg(0) == "cache" {
+		os.Exit(app.cacheCommand(flag.Args()[1:]))
+	}
+
+	// The batch subcommand takes any number of deck files, each written to
+	// --output-dir, and serve takes its decks from HTTP requests.
+	if app.prewarmDeck != "" && !serve {
+		usagef("--cache-prewarm-on-start can only be used with serve")
+	}
+	if batch {
+		if len(batchInputs) == 0 || app.outputDir == "" {
+			usagef("usage: %s [options] --output-dir <dir> batch <input.o8d>...", os.Args[0])
+		}
+		if app.outputFile != "" || len(app.encounterSets) > 0 || app.listPacks || app.cardInfoJSON != "" {
+			usagef("batch can't be used with --output, --encounter-set, --list-packs or --card-info-json")
+		}
+	} else if serve {
+		if flag.NArg() != 1 {
+			usagef("usage: %s [options] serve", os.Args[0])
+		}
+		if app.outputFile != "" || app.outputDir != "" || app.sectionsDir != "" || app.splitBySection || app.splitEvery > 0 ||
+			app.zipOutput || app.format != "pdf" || app.watch || app.listPacks || len(app.encounterSets) > 0 {
+			usagef("serve writes one PDF per request; it can't be used with --output, --output-dir, --sections-as-files, " +
+				"--split-by-section, --split-every, --zip-output, --format, --watch, --list-packs or --encounter-set")
+		}
+	} else {
+		// Check for correct usage: the output file is either given with
+		// --output or, as originally, as a second argument after the input
+		// file.  --encounter-set takes the place of the input file, which is
+		// optional with --card, and --list-packs needs neither.
+		inputs, outputs := 1, 1
+		if len(app.encounterSets) > 0 {
+			inputs = 0
+		}
+		if app.outputFile != "" || app.outputDir != "" || app.sectionsDir != "" {
+			outputs = 0
+		}
+		if app.listPacks {
+			inputs, outputs = 0, 0
+		}
+		if len(cardNames) > 0 && flag.NArg() == outputs {
+			inputs = 0
+		}
+		if flag.NArg() != inputs+outputs {
+			flag.Usage()
+			os.Exit(exitUsage)
+		}
+		if inputs == 1 {
+			app.inputFile = flag.Arg(0)
+		}
+		if outputs == 1 {
+			app.outputFile = flag.Arg(inputs)
+		}
+		if app.outputDir != "" && app.outputFile != "" {
+			usagef("give either --output-dir or an output file, not both")
+		}
+		if fi, err := os.Stat(app.outputFile); err == nil && fi.IsDir() {
+			app.outputDir, app.outputFile = app.outputFile, ""
+		}
+	}
+	if app.outputDir != "" && app.sectionsDir != "" {
+		usagef("--output-dir and --sections-as-files can't be used together")
+	}
+	if app.watch && (batch || app.listPacks || app.inputFile == "" || app.inputFile == stdinInput) {
+		usagef("--watch needs a single input file")
+	}
+
+	if app.cardPrintDPI != 0 && (app.cardPrintDPI < 0 || app.cardWidthPx <= 0 || app.cardHeightPx <= 0) {
+		usagef("--card-print-scale needs a positive dpi, --card-width-px and --card-height-px")
+	}
+	if app.render.FontScale <= 0 {
+		usagef("font scale must be positive")
+	}
+	if app.border < 0 {
+		usagef("--border must not be negative")
+	}
+	app.layout, ok = app.pageLayout(app.pageSizePreset)
+	if !ok {
+		usagef("unknown page size preset %q", app.pageSizePreset)
+	}
+	if app.draft {
+		app.imageProc.Grayscale = true
+		app.imageProc.Compress = true
+		if !flagWasSet("jpeg-quality") {
+			app.imageProc.JPEGQuality = draftJPEGQuality
+		}
+	}
+	if app.imageProc.JPEGQuality < 1 || app.imageProc.JPEGQuality > 100 {
+		usagef("JPEG quality must be between 1 and 100")
+	}
+	if app.imageProc.Brightness < -100 || app.imageProc.Brightness > 100 {
+		usagef("brightness must be between -100 and 100")
+	}
+	if app.imageProc.Gamma <= 0 {
+		usagef("gamma must be positive")
+	}
+	if app.imageProc.FoilOpacity < 0 || app.imageProc.FoilOpacity > 255 {
+		usagef("foil opacity must be between 0 and 255")
+	}
+	app.imageProc.SetPrintSize(app.layout.CardWidth, app.layout.CardHeight)
+	if app.format != "pdf" && app.format != "png" && app.format != "html" {
+		usagef("unknown output format %q", app.format)
+	}
+	switch app.render.ImageFit {
+	case fitFill, fitContain, fitCover:
+	default:
+		usagef("unknown card image fit %q", app.render.ImageFit)
+	}
+	if app.pngDPI <= 0 {
+		usagef("PNG resolution must be positive")
+	}
+	if skipSections != "" {
+		app.skipSections, err = regexp.Compile(skipSections)
+		if err != nil {
+			usagef("bad --skip-sections pattern: %v", err)
+		}
+	}
+	for _, s := range cardNames {
+		spec, err := parseCardSpec(s)
+		if err != nil {
+			usagef("error: %v", err)
+		}
+		app.cardSpecs = append(app.cardSpecs, spec)
+	}
+	if packsOwned != "" {
+		app.packsOwned, err = readPackList(packsOwned)
+		if err != nil {
+			usagef("error: %v", err)
+		}
+	}
+	if app.schemaVersion < minDeckSchemaVersion || app.schemaVersion > maxDeckSchemaVersion {
+		usagef("unknown deck schema version %d", app.schemaVersion)
+	}
+	if app.inputFormat != inputAuto && app.inputFormat != inputXML && app.inputFormat != inputIDs {
+		usagef("unknown input format %q", app.inputFormat)
+	}
+	if app.httpTimeout <= 0 || app.imageTimeout <= 0 {
+		usagef("HTTP timeouts must be positive")
+	}
+	if app.rateLimit < 0 {
+		usagef("--rate-limit must not be negative")
+	}
+	app.fetch = newFetcher(app.httpTimeout, app.rateLimit)
+	if app.render.Watermark.Opacity <= 0 || app.render.Watermark.Opacity > 1 {
+		usagef("--watermark-opacity must be greater than 0 and at most 1")
+	}
+	switch app.render.Watermark.Position {
+	case watermarkCenter, watermarkBottom, watermarkDiagonal:
+	default:
+		usagef("unknown watermark position %q", app.render.Watermark.Position)
+	}
+	maxRadius := math.Min(app.layout.CardWidth, app.layout.CardHeight) / 2
+	if app.render.CornerRadius < 0 || app.render.CornerRadius > maxRadius {
+		usagef("--round-corners must be between 0 and %.1f, half the card's shorter side", maxRadius)
+	}
+	if app.imageCacheTTL < 0 {
+		usagef("--image-cache-ttl must not be negative")
+	}
+	if app.render.BorderWidth < 0 {
+		usagef("--card-image-border-width must not be negative")
+	}
+	if app.render.Bleed < 0 {
+		usagef("--page-bleed-box must not be negative")
+	}
+	if app.splitEvery < 0 {
+		usagef("--split-every must not be negative")
+	}
+	if app.sectionsDir != "" {
+		err := os.MkdirAll(app.sectionsDir, 0755)
+		if err != nil {
+			exitf(exitOutput, "error: %v", err)
+		}
+	}
+	if app.grouping != "consecutive" && app.grouping != "dispersed" {
+		usagef("unknown card grouping strategy %q", app.grouping)
+	}
+	if app.lang == "en" {
+		app.lang = ""
+	}
+	if app.lang != "" && !isLanguage(app.lang) {
+		usagef("unknown language %q", app.lang)
+	}
+	app.imageSources.Lang = app.lang
+	app.imageSources.Order, err = parseImageSources(app.sourceList)
+	if err != nil {
+		usagef("error: %v", err)
+	}
+	if !app.game.HallOfBeorn {
+		app.imageSources = app.imageSources.without(sourceHallOfBeorn)
+		if len(app.imageSources.Order) == 0 {
+			usagef("Hall of Beorn has no images for %s", app.gameName)
+		}
+	}
+	if !isWholeDeckSortField(app.sortBy) {
+		usagef("unknown sort field %q", app.sortBy)
+	}
+	if app.copies < 1 {
+		usagef("--copies must be at least 1")
+	}
+	if app.copies > 1 && app.format != "pdf" {
+		usagef("--copies needs --format pdf")
+	}
+	if app.zipOutput && app.format != "pdf" {
+		usagef("--zip-output needs --format pdf")
+	}
+	app.buildTime = time.Now()
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			usagef("SOURCE_DATE_EPOCH %q is not a number of seconds", epoch)
+		}
+		app.reproducible = true
+		app.buildTime = time.Unix(secs, 0).UTC()
+	} else if app.reproducible {
+		app.buildTime = time.Unix(0, 0).UTC()
+	}
+	if app.render.Stamp == stampDefault {
+		app.render.Stamp = "Generated by lotrproxypdf on " + app.buildTime.Format("2006-01-02")
+	}
+	if app.cardBacks && app.cardBackURL == "" {
+		usagef("--card-backs needs --card-back-image-url")
+	}
+	switch app.fillEmpty {
+	case fillBlank:
+	case fillBack:
+		if app.cardBackURL == "" {
+			usagef("--fill-empty back needs --card-back-image-url")
+		}
+	default:
+		app.render.Filler, err = fillerImage(app.fillEmpty)
+		if err != nil {
+			usagef("error: %v", err)
+		}
+	}
+	if app.metadataUpdate != updateEager && app.metadataUpdate != updateLazy {
+		usagef("unknown metadata update strategy %q", app.metadataUpdate)
 	}
+	if app.outputDir != "" && !app.listPacks && !batch {
+		app.outputFile = app.autoOutputPath(app.outputDir)
+		logInfo("writing to %s", app.outputFile)
+	}
+	app.outputDone = make(chan struct{})
+	app.interactive = !app.nonInteractive && isTerminal(os.Stdin) && app.inputFile != stdinInput
+	app.nameChoices = make(map[string]string)
 
-	app := &App{
-		cache:      configdir.New(vendorName, appConfigName).QueryCacheFolder(),
-		inputFile:  os.Args[1],
-		outputFile: os.Args[2],
+	var cancel context.CancelFunc
+	app.ctx, cancel = withInterrupt(context.Background())
+	defer cancel()
+	if app.timeout > 0 && !serve {
+		app.ctx, cancel = context.WithTimeout(app.ctx, app.timeout)
+		defer cancel()
 	}
 
 	// App uses the error monad pattern; any error will shortcut later steps.
-	app.LoadMetadata()
-	app.ParseInputFile()
-	app.PreloadImages()
-	app.CreatePDF()
+	timeStage("metadata", app.LoadMetadata)
+	switch {
+	case app.listPacks:
+		app.ListPacks()
+	case batch:
+		app.RunBatch(batchInputs)
+	case serve:
+		app.Serve()
+	default:
+		app.runPipeline()
+	}
+	close(app.outputDone)
+	if app.watch {
+		app.Watch()
+	}
+	app.asyncSaves.Wait()
 
-	if app.err != nil {
-		log.Fatalf("error: %v", app.err)
+	switch {
+	case app.err == nil:
+		if app.outputDir != "" && !app.listPacks && !batch {
+			fmt.Println(app.outputFile)
+		}
+	case app.ctx.Err() == context.DeadlineExceeded:
+		exitf(exitCancelled, "run cancelled: --timeout of %v exceeded", app.timeout)
+	case app.ctx.Err() != nil:
+		exitf(exitCancelled, "run cancelled")
+	default:
+		exitf(exitCode(app.err), "error: %v", app.err)
+	}
+}
+
+// pageLayout returns the layout of a page size preset with the card size,
+// labels and border the options call for.
+func (app *App) pageLayout(preset string) (Layout, bool) {
+	layout, ok := pageSizePresets[preset]
+	if !ok {
+		return Layout{}, false
 	}
+	if app.cardPrintDPI != 0 {
+		layout = layout.WithCardSize(
+			float64(app.cardWidthPx)/float64(app.cardPrintDPI)*mmPerInch,
+			float64(app.cardHeightPx)/float64(app.cardPrintDPI)*mmPerInch,
+		)
+	}
+	if app.labels {
+		layout = layout.WithLabelHeight(labelHeight * app.render.FontScale)
+	}
+	if app.border > 0 {
+		layout = layout.WithBorder(app.border)
+	}
+	return layout, true
+}
+
+// runPipeline reads the deck and writes its outputs.
+func (app *App) runPipeline() {
+	timeStage("parse", app.ParseInputFile)
+	timeStage("images", app.PreloadImages)
+	app.EvictCachedImages()
+	timeStage("card back", app.LoadCardBack)
+	timeStage("pdf", app.CreatePDF)
+	timeStage("png", app.CreatePNG)
+	timeStage("html", app.CreateHTML)
+	app.ReportMissingImages()
+	app.WriteCardInfo()
+}
+
+// withInterrupt returns a context that is cancelled on SIGINT or SIGTERM.
+// Later signals get their default behavior, so a second Ctrl-C exits at
+// once.
+func withInterrupt(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			logWarn("interrupted; stopping")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, cancel
 }
 
 func (app *App) LoadMetadata() {
 	if app.err != nil {
 		return
 	}
+	defer app.failed(stageMetadata)
 
 	// Try loading from cache
 	var err error
-	app.octgnToImgName, err = loadFromCache(app.cache)
+	var stale bool
+	app.octgnToCard, stale, err = loadFromCache(app.cache, app.manifest, app.cacheDBFile())
 	// Return if it worked or fall through to refetching from the API
-	if err == nil {
+	switch {
+	case err == nil && !stale:
 		return
-	}
-	if err != errIgnoreCache {
-		log.Printf("warning: failed loading metadata from cache: %v", err)
+	case err == nil && app.metadataUpdate == updateLazy:
+		if app.cacheReadOnly {
+			logInfo("using stale cached metadata")
+			return
+		}
+		logInfo("using stale cached metadata; refreshing it in the background")
+		app.asyncSaves.Add(1)
+		go func() {
+			defer app.asyncSaves.Done()
+			app.refreshMetadata()
+		}()
+		return
+	case err != nil && err != errIgnoreCache:
+		logWarn("failed loading metadata from cache: %v", err)
 	}
 
 	// Fetch from the API and cache the result
-	log.Print("fetching metadata from ringsdb.com")
-	var data []byte
-	data, app.err = httpGetBytes(ringsURLGetAll)
-	if app.err != nil {
+	var etag string
+	app.octgnToCard, etag, app.err = fetchMetadata(app.ctx, app.fetch, app.metadataURLs(), app.game, app.inputJSONPath, app.maxNameLength)
+	if app.err != nil || app.cacheReadOnly {
 		return
 	}
-	app.octgnToImgName, app.err = convertRingsDataToMap(data)
-	if app.err != nil {
+	if app.asyncSave {
+		app.asyncSaves.Add(1)
+		go func(cards map[string]CardInfo) {
+			defer app.asyncSaves.Done()
+			app.saveMetadata(cards, etag)
+		}(app.octgnToCard)
 		return
 	}
-	err = saveToCache(app.cache, app.octgnToImgName)
+	app.saveMetadata(app.octgnToCard, etag)
+}
+
+// refreshMetadata fetches metadata for later runs with
+// --metadata-update-strategy lazy.  It saves it to the cache once this
+// run's output is written, and only warns if anything fails.
+func (app *App) refreshMetadata() {
+	cards, etag, err := fetchMetadata(app.ctx, app.fetch, app.metadataURLs(), app.game, app.inputJSONPath, app.maxNameLength)
 	if err != nil {
-		log.Printf("warning: failed saving metadata to cache: %v", err)
+		logWarn("failed refreshing metadata in the background: %v", err)
+		return
+	}
+	<-app.outputDone
+	app.saveMetadata(cards, etag)
+}
+
+// metadataURLs lists the URLs to fetch metadata from, in order.
+func (app *App) metadataURLs() []string {
+	urls := []string{app.game.metadataURL(app.lang)}
+	if app.apiFallbackURL != "" {
+		urls = append(urls, app.apiFallbackURL)
+	}
+	return urls
+}
+
+// cacheDBFile is the name of the gzipped cached metadata file, which is kept
+// separately for each language.
+func (app *App) cacheDBFile() string {
+	if app.lang == "" {
+		return cacheDBName + ".json.gz"
 	}
+	return cacheDBName + "-" + app.lang + ".json.gz"
 }
 
-func httpGetBytes(url string) ([]byte, error) {
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(url)
+func (app *App) saveMetadata(cards map[string]CardInfo, etag string) {
+	err := saveToCache(app.cache, app.manifest, app.cacheDBFile(), cards, etag)
 	if err != nil {
-		return nil, err
+		logWarn("failed saving metadata to cache: %v", err)
+	}
+}
+
+// fetchMetadata tries each URL in turn and returns the metadata, and its
+// ETag if any, from the first one that responds with valid card data.  If
+// jsonPath is not empty, the card array is found at that path in the
+// response.
+func fetchMetadata(ctx context.Context, f *fetcher, urls []string, game Game, jsonPath string, maxNameLength int) (map[string]CardInfo, string, error) {
+	var err error
+	for _, url := range urls {
+		logInfo("fetching metadata from %s", url)
+		var data []byte
+		var header http.Header
+		var cards map[string]CardInfo
+		data, header, err = f.get(ctx, url, 0)
+		if err == nil && jsonPath != "" {
+			data, err = extractJSONPath(data, jsonPath)
+		}
+		if err == nil {
+			cards, err = convertRingsDataToMap(data, game, maxNameLength)
+		}
+		if err == nil {
+			countLog(len(cards)).info("fetched metadata from %s", url)
+			return cards, header.Get("ETag"), nil
+		}
+		if ctx.Err() != nil {
+			return nil, "", err
+		}
+		logWarn("failed fetching metadata from %s: %v", url, err)
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	return nil, "", err
+}
+
+// extractJSONPath returns the JSON array found by following the
+// dot-separated object keys of path from the top of a JSON document.
+func extractJSONPath(body []byte, path string) ([]byte, error) {
+	var node interface{}
+	err := json.Unmarshal(body, &node)
 	if err != nil {
 		return nil, err
 	}
-	return body, nil
+
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("json path %q: %q is not inside an object", path, key)
+		}
+		node, ok = obj[key]
+		if !ok {
+			return nil, fmt.Errorf("json path %q: key %q not found", path, key)
+		}
+	}
+
+	if _, ok := node.([]interface{}); !ok {
+		return nil, fmt.Errorf("json path %q is not an array", path)
+	}
+	return json.Marshal(node)
 }
 
 // store URLs as just final filename so it's easier to combine
-// into full URL or cache file path
-func convertRingsDataToMap(body []byte) (map[string]string, error) {
-	var cardList []RingsCard
-	err := json.Unmarshal(body, &cardList)
+// into full URL or cache file path; records with names longer than
+// maxNameLength characters are skipped unless maxNameLength is zero
+func convertRingsDataToMap(body []byte, game Game, maxNameLength int) (map[string]CardInfo, error) {
+	cardList, err := game.decode(body)
 	if err != nil {
 		return nil, err
 	}
 
-	images := make(map[string]string)
+	cards := make(map[string]CardInfo)
 	for _, v := range cardList {
-		if v.ImageSrc == "" {
+		if n := utf8.RuneCountInString(v.Name); maxNameLength > 0 && n > maxNameLength {
+			logWarn("skipping card %q with %d character name (limit %d): %.60q...", v.ID, n, maxNameLength, v.Name)
 			continue
 		}
-		images[v.ID] = strings.TrimPrefix(v.ImageSrc, ringsImagePrefix)
+		cards[v.ID] = CardInfo{
+			Name:   v.Name,
+			Code:   v.Code,
+			Image:  strings.TrimPrefix(v.ImageSrc, game.ImagePrefix),
+			Cost:   string(v.Cost),
+			Sphere: v.Sphere,
+			Type:   v.Type,
+
+			Pack:     v.PackCode,
+			PackName: v.PackName,
+
+			EncounterSet: v.EncounterSet,
+			Quantity:     v.Quantity,
+		}
 	}
 
-	return images, nil
+	return cards, nil
 }
 
-func loadFromCache(cache *configdir.Config) (map[string]string, error) {
-	if !cache.Exists(cacheDBName) {
-		return nil, errIgnoreCache
+// loadFromCache reads cached metadata and reports whether it is stale.
+func loadFromCache(cache *configdir.Config, manifest *cacheManifest, dbName string) (map[string]CardInfo, bool, error) {
+	// Until it is next refetched, metadata may still be in the uncompressed
+	// file written by earlier versions.
+	if !cache.Exists(dbName) && cache.Exists(uncompressedName(dbName)) {
+		dbName = uncompressedName(dbName)
+	}
+	logDebug("metadata cache: %s", filepath.Join(cache.Path, dbName))
+	if !cache.Exists(dbName) {
+		return nil, false, errIgnoreCache
 	}
 
-	// Ignore cached file if more than 24 hours old.
-	stat, err := os.Stat(filepath.Join(cache.Path, cacheDBName))
-	if err != nil {
-		return nil, err
+	// Ignore metadata not fetched by this cache format version.
+	if _, ok := manifest.metadata(dbName); !ok {
+		return nil, false, errIgnoreCache
 	}
-	if time.Since(stat.ModTime()) > 24*time.Hour {
-		return nil, errIgnoreCache
+
+	// The cached file is stale if more than 24 hours old.
+	stat, err := os.Stat(filepath.Join(cache.Path, dbName))
+	if err != nil {
+		return nil, false, err
 	}
+	stale := time.Since(stat.ModTime()) > metadataMaxAge
 
 	// Read and unmarshal cached file
-	bytes, err := cache.ReadFile(cacheDBName)
+	bytes, err := cache.ReadFile(dbName)
+	if err == nil && dbName != uncompressedName(dbName) {
+		bytes, err = gunzip(bytes)
+	}
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	var images map[string]string
-	err = json.Unmarshal(bytes, &images)
+	var cards map[string]CardInfo
+	err = json.Unmarshal(bytes, &cards)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	log.Print("loaded card metadata from cache")
-	return images, nil
+	if !stale {
+		logInfo("loaded card metadata from cache")
+	}
+	return cards, stale, nil
 }
 
-func saveToCache(cache *configdir.Config, images map[string]string) error {
-	bytes, err := json.Marshal(images)
+func saveToCache(cache *configdir.Config, manifest *cacheManifest, dbName string, cards map[string]CardInfo, etag string) error {
+	bytes, err := json.Marshal(cards)
+	if err == nil {
+		bytes, err = gzipBytes(bytes)
+	}
 	if err != nil {
 		return err
 	}
 
-	err = cache.WriteFile(cacheDBName, bytes)
+	err = manifest.storeMetadata(dbName, bytes, etag)
 	if err != nil {
 		return err
 	}
+	_ = os.Remove(filepath.Join(cache.Path, uncompressedName(dbName)))
 
-	log.Print("saved card metadata to cache")
+	logInfo("saved card metadata to cache")
 	return nil
 }
 
@@ -208,127 +1134,954 @@ func (app *App) ParseInputFile() {
 	if app.err != nil {
 		return
 	}
-
-	var data []byte
-	data, app.err = ioutil.ReadFile(app.inputFile)
-	if app.err != nil {
-		return
-	}
+	defer app.failed(stageInput)
 
 	var deck XMLDeck
-	app.err = xml.Unmarshal(data, &deck)
+	switch {
+	case len(app.encounterSets) > 0:
+		deck, app.err = app.encounterSetDeck()
+	case app.inputFile != "":
+		deck, app.err = app.readDeckFile(app.inputFile)
+	}
 	if app.err != nil {
 		return
 	}
+	if len(app.cardSpecs) > 0 {
+		var section XMLSection
+		section, app.err = app.namedCardsSection()
+		if app.err != nil {
+			return
+		}
+		deck.Sections = append(deck.Sections, section)
+	}
 
 	flat := make([]XMLCard, 0)
+	skipped := 0
 	for _, section := range deck.Sections {
+		if !app.includeExtras && isExtrasSection(section.Name) {
+			logInfo("leaving out section %q", section.Name)
+			continue
+		}
+		if app.skipSections != nil && app.skipSections.MatchString(section.Name) {
+			logInfo("leaving out section %q", section.Name)
+			skipped++
+			continue
+		}
 		for _, card := range section.Cards {
-			card.ImagePath = app.octgnToImgName[card.OctgnID]
+			info := app.octgnToCard[card.OctgnID]
+			card.ImagePath = info.Image
+			if card.ImagePath != "" && app.lang != "" {
+				card.ImagePath = path.Join(app.lang, card.ImagePath)
+			}
+			card.Name = info.Name
+			card.Section = section.Name
+			card.Cost = info.Cost
+			card.Sphere = info.Sphere
+			card.Type = info.Type
+			card.Pack = info.Pack
+			card.Code = info.Code
+			if card.Name == "" {
+				card.Name = strings.TrimSpace(card.Card)
+			}
+			if app.imagesDir != "" {
+				var override string
+				override, app.err = findImageOverride(app.imagesDir, card)
+				if app.err != nil {
+					return
+				}
+				if override != "" {
+					imageLog(override).info("using %s for %s", override, card.Name)
+					card.ImagePath = override
+					card.Override = true
+				}
+			}
+			if card.ImagePath == "" && info.Name != "" && app.imageSources.has(sourceHallOfBeorn) {
+				card.ImagePath = path.Join(hallOfBeornFolder, sanitizeFileName(info.Name)+".jpg")
+			}
 			if card.ImagePath == "" {
-				log.Println("no image available for", card.Card, "(skipping it)")
+				logInfo("no image available for %s (skipping it)", card.Card)
+				app.missing = append(app.missing, card.OctgnID)
 				continue
 			}
 			flat = append(flat, card)
 		}
 	}
 
-	app.deck = flat
-}
+	if app.skipSections != nil && skipped == 0 {
+		logWarn("--skip-sections %q matched no sections", app.skipSections)
+	}
 
-func (app *App) PreloadImages() {
-	if app.err != nil {
-		return
+	if len(app.packsOwned) > 0 {
+		flat = app.leaveOutOwnedPacks(flat)
 	}
 
-	wg := sync.WaitGroup{}
-	var errMap sync.Map
-	for _, card := range app.deck {
-		if !app.cache.Exists(filepath.Join(cacheImageFolder, card.ImagePath)) {
-			wg.Add(1)
-			go func(card XMLCard) {
-				defer wg.Done()
-				err := loadImageToCache(app.cache, card.ImagePath)
-				if err != nil {
-					errMap.Store(card.ImagePath, err)
-					return
-				}
-				log.Printf("Fetched %s to cache", card.ImagePath)
-			}(card)
+	if app.ownedFile != "" {
+		var owned collection
+		owned, app.err = readCollection(app.ownedFile, app.octgnToCard)
+		if app.err != nil {
+			return
+		}
+		var removed int
+		flat, removed = owned.subtract(flat)
+		printing := 0
+		for _, card := range flat {
+			printing += card.Quantity
 		}
+		countLog(printing).info("skipped %d owned copies, printing %d proxies", removed, printing)
 	}
-	wg.Wait()
 
-	var errs []string
-	errMap.Range(func(k, v interface{}) bool {
-		errs = append(errs, fmt.Sprintf("%s (%s)", k.(string), v.(error).Error()))
-		return true
-	})
-	if len(errs) > 0 {
-		app.err = fmt.Errorf("error(s) fetching images: %s", strings.Join(errs, "; "))
+	if len(app.renderOrder) > 0 {
+		sortDeck(flat, app.renderOrder)
+	}
+	if app.sortBy != sortNone {
+		sortWholeDeck(flat, app.sortBy)
+	}
+	if app.expandEarly {
+		flat = app.expandDeck(flat)
+		for i := range flat {
+			flat[i].Quantity = 1
+		}
 	}
+	app.deck = flat
 }
 
-func loadImageToCache(cache *configdir.Config, imageName string) error {
-	cachePath := filepath.Join(cacheImageFolder, imageName)
-	urlPath := ringsURL + path.Join(ringsImagePrefix, imageName)
-
-	imageBytes, err := httpGetBytes(urlPath)
-	if err != nil {
-		return err
+// readDeckFile reads an OCTGN deck file, a set.xml file of a whole pack or
+// a list of OCTGN IDs, from standard input if name is stdinInput.
+func (app *App) readDeckFile(name string) (XMLDeck, error) {
+	var data []byte
+	var err error
+	if name == stdinInput {
+		name = "standard input"
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(name)
 	}
-
-	err = cache.WriteFile(cachePath, imageBytes)
 	if err != nil {
-		return err
+		return XMLDeck{}, err
 	}
-
-	return nil
-}
-
-func (app *App) CreatePDF() {
-	if app.err != nil {
-		return
+	if app.inputFormat == inputIDs || app.inputFormat == inputAuto && isIDList(data) {
+		return parseIDList(data, name, app.octgnToCard)
 	}
-
-	if len(app.deck) == 0 {
-		log.Println("no cards in the deck; will not create PDF")
-		return
+	if isOCTGNSet(data) {
+		return parseSetFile(data)
 	}
+	return parseDeck(data, app.schemaVersion)
+}
 
-	pdf := gofpdf.New("P", "mm", "Letter", "")
+// isExtrasSection reports whether a deck section holds bonus cards outside
+// the main deck.
+func isExtrasSection(name string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return name == "extras" || name == "extra"
+}
 
-	var deck []XMLCard
-	deck, app.err = addImagesToPdf(pdf, app.cache, app.deck)
-	if app.err != nil {
-		return
+// findImageOverride returns the path of the file in dir to use in place of a
+// card's cached image, or "" if there is none.  It is an error for an override
+// file not to be a supported image.
+func findImageOverride(dir string, card XMLCard) (string, error) {
+	candidates := []string{card.OctgnID + ".jpg", card.OctgnID + ".jpeg", card.OctgnID + ".png"}
+	if card.ImagePath != "" {
+		candidates = append(candidates, filepath.FromSlash(card.ImagePath))
 	}
+	for _, name := range candidates {
+		p := filepath.Join(dir, name)
+		head, err := readFileHead(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if (getImageOptions(head, card) == gofpdf.ImageOptions{}) {
+			return "", fmt.Errorf("image override %s is not a JPEG, PNG or GIF image", p)
+		}
+		return p, nil
+	}
+	return "", nil
+}
 
-	app.err = renderPDF(pdf, deck, app.outputFile)
+func (app *App) PreloadImages() {
+	if app.err != nil {
+		return
+	}
+	defer app.failed(stageImages)
+
+	var failed map[string]error
+	failed, app.err = app.fetchImages(app.deck)
+	if app.err == nil && len(failed) > 0 {
+		app.err = imageErrors(failed)
+	}
 }
 
-func addImagesToPdf(pdf *gofpdf.Fpdf, cache *configdir.Config, deck []XMLCard) ([]XMLCard, error) {
-	deckWithValidImages := make([]XMLCard, 0)
+// fetchImages downloads the images of the given cards that aren't cached
+// or have expired.  It returns the error for each image that could not be
+// fetched, or an error if the run was cancelled.
+func (app *App) fetchImages(deck []XMLCard) (map[string]error, error) {
+	wg := sync.WaitGroup{}
+	var errMap sync.Map
+	// Cards in several sections share an image, which is fetched only once.
+	seen := make(map[string]bool)
 	for _, card := range deck {
-		imageBytes, err := cache.ReadFile(filepath.Join(cacheImageFolder, card.ImagePath))
+		if app.ctx.Err() != nil {
+			break
+		}
+		if card.Override || seen[card.ImagePath] {
+			continue
+		}
+		seen[card.ImagePath] = true
+		cached := app.imageCached(card)
+		expired := cached && app.imageExpired(card)
+		if cached && !expired {
+			continue
+		}
+		if app.cacheReadOnly {
+			imageLog(card.ImagePath).info("%s is not in the read-only cache", card.ImagePath)
+			continue
+		}
+		wg.Add(1)
+		go func(card XMLCard, expired bool) {
+			defer wg.Done()
+			err := loadImageToCache(app.ctx, app.fetch, app.cache, app.manifest, app.remoteCache, app.imageSources, card, app.imageTimeout)
+			if err != nil && expired && app.ctx.Err() == nil {
+				imageLog(card.ImagePath).warn("failed refreshing %s: %v (using the expired copy)", card.ImagePath, err)
+				return
+			}
+			if err != nil {
+				errMap.Store(card.ImagePath, err)
+				return
+			}
+			imageLog(card.ImagePath).info("Fetched %s to cache", card.ImagePath)
+		}(card, expired)
+	}
+	wg.Wait()
+	if app.ctx.Err() != nil {
+		return nil, app.ctx.Err()
+	}
+
+	failed := make(map[string]error)
+	errMap.Range(func(k, v interface{}) bool {
+		failed[k.(string)] = v.(error)
+		return true
+	})
+	return failed, nil
+}
+
+// imageErrors combines the errors fetching images into one.
+func imageErrors(failed map[string]error) error {
+	errs := make([]string, 0, len(failed))
+	for imagePath, err := range failed {
+		errs = append(errs, fmt.Sprintf("%s (%s)", imagePath, err.Error()))
+	}
+	sort.Strings(errs)
+	return fmt.Errorf("error(s) fetching images: %s", strings.Join(errs, "; "))
+}
+
+// imageCached reports whether a card's image is in the cache and intact,
+// marking it as recently used for EvictCachedImages.  An image that doesn't
+// match its checksum is removed so it is fetched again.
+func (app *App) imageCached(card XMLCard) bool {
+	exists, ok := app.manifest.checkImage(card.ImagePath)
+	if ok && !app.cacheReadOnly {
+		now := time.Now()
+		_ = os.Chtimes(imageFile(app.cache, card), now, now)
+	}
+	if exists && !ok {
+		imageLog(card.ImagePath).warn("cached %s is corrupt", card.ImagePath)
+		if !app.cacheReadOnly {
+			_ = os.Remove(imageFile(app.cache, card))
+			_ = app.manifest.forgetImage(card.ImagePath)
+		}
+	}
+	return ok
+}
+
+// loadImageToCache fetches a card's image into the local cache, allowing each
+// download the given timeout.  If a remote cache is given, it is tried before
+// the image sources, in order, and any image fetched from a source is
+// uploaded to it.
+func loadImageToCache(ctx context.Context, f *fetcher, cache *configdir.Config, manifest *cacheManifest, remote string, sources imageSources, card XMLCard, timeout time.Duration) error {
+	imageName := card.ImagePath
+	cachePath := filepath.Join(cacheImageFolder, imageName)
+	imageLog(imageName).debug("caching %s as %s", card.Name, filepath.Join(cache.Path, cachePath))
+
+	if remote != "" {
+		imageBytes, err := f.getBytes(ctx, remoteImageURL(remote, imageName), timeout)
+		if err == nil {
+			imageLog(imageName).info("fetched %s from remote cache", imageName)
+			return manifest.storeImage(imageName, imageBytes)
+		}
+	}
+
+	imageBytes, err := sources.fetch(ctx, f, card, timeout)
+	if err != nil {
+		return err
+	}
+
+	err = manifest.storeImage(imageName, imageBytes)
+	if err != nil {
+		return err
+	}
+
+	if remote != "" {
+		err = f.put(ctx, remoteImageURL(remote, imageName), imageBytes)
 		if err != nil {
-			if os.IsNotExist(err) {
-				log.Println("no cached image for", card.Card, "(skipping it)")
-				continue
-			} else {
-				return nil, err
+			imageLog(imageName).warn("failed uploading %s to remote cache: %v", imageName, err)
+		}
+	}
+
+	return nil
+}
+
+func remoteImageURL(remote string, imageName string) string {
+	return strings.TrimSuffix(remote, "/") + path.Join("/images", imageName)
+}
+
+func (app *App) CreatePDF() {
+	if app.err != nil || app.format != "pdf" {
+		return
+	}
+	defer app.failed(stageOutput)
+
+	if len(app.deck) == 0 {
+		logInfo("no cards in the deck; will not create PDF")
+		return
+	}
+
+	for _, group := range app.outputGroups() {
+		app.err = app.writePDF(group)
+		if app.err != nil {
+			return
+		}
+	}
+}
+
+// writePDF lays out a group's cards into pages and writes them to one PDF,
+// or to several numbered part files if --split-every is set.
+func (app *App) writePDF(group outputGroup) error {
+	cards := app.expandDeck(group.deck)
+	if !app.collate {
+		cards = repeatCards(cards, app.copies)
+	}
+	check := newImageCheck(app.cache, app.cacheReadOnly)
+	pages, err := paginate(cards, app.layout.CardsPerPage(), check.usable)
+	app.missing = append(app.missing, check.skipped...)
+	if err != nil {
+		return err
+	}
+	if len(pages) == 0 {
+		logInfo("no usable card images; will not create %s", group.path)
+		return nil
+	}
+	if app.collate {
+		pages = repeatPages(pages, app.copies)
+	}
+
+	// Each page of fronts is followed by a page of backs, if printed.
+	sides := 1
+	if app.render.Back != nil {
+		sides = 2
+	}
+
+	var summary [][]summaryRow
+	if app.summary {
+		summary = paginateSummary(summaryRows(group.deck), summaryRowsPerPage(app.layout))
+	}
+
+	parts := splitPages(app.splitEvery, pages)
+	var sizeBefore, sizeAfter int
+	firstPage := 1
+	copies := make(map[string]int)
+	for i, part := range parts {
+		outputPath := group.path
+		if len(parts) > 1 {
+			outputPath = partFileName(group.path, i+1)
+		}
+		// The summary goes only in the first part, before the cards.
+		summaryPages := 0
+		if i == 0 {
+			summaryPages = len(summary) * sides
+		}
+		if app.tocJSON {
+			err = writeTOC(tocFileName(outputPath), tableOfContents(part, app.layout.Cols, sides, summaryPages, copies))
+			if err != nil {
+				return err
+			}
+		}
+
+		pdf := gofpdf.NewCustom(&gofpdf.InitType{
+			OrientationStr: "P",
+			UnitStr:        "mm",
+			Size:           gofpdf.SizeType{Wd: app.layout.PageWidth, Ht: app.layout.PageHeight},
+		})
+
+		if app.pdfCreator != "" {
+			pdf.SetCreator(app.pdfCreator, true)
+		}
+		pdf.SetCreationDate(app.buildTime)
+		if app.reproducible {
+			// Write fonts and images in name order rather than map order.
+			pdf.SetCatalogSort(true)
+		}
+		if app.render.Bleed > 0 {
+			setPageBoxes(pdf, app.layout, app.render.Bleed)
+		}
+		if app.footer {
+			err = setFooter(pdf, app.layout, footerInfo{
+				Name:       group.name,
+				Date:       app.buildTime,
+				FirstPage:  firstPage,
+				TotalPages: len(pages) * sides,
+				SkipPages:  summaryPages,
+				Part:       i + 1,
+				Parts:      len(parts),
+				FontScale:  app.render.FontScale,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		images := newPDFImages(pdf, app.cache, app.cacheReadOnly, app.imageProc, app.noImageDedup)
+		images.cardAspect = app.layout.CardWidth / app.layout.CardHeight
+		images.strictAspect = app.strictAspect
+		if summaryPages > 0 {
+			renderSummary(pdf, app.layout, group.name, app.buildTime, summary, sides == 2)
+		}
+		err = renderPDF(pdf, images, app.layout, app.render, group.name, part)
+		sizeBefore += images.sizeBefore
+		sizeAfter += images.sizeAfter
+		if err != nil {
+			return err
+		}
+		write := pdf.Output
+		if app.reproducible {
+			write = func(w io.Writer) error { return writeCanonicalPDF(pdf, w) }
+		}
+		if app.zipOutput {
+			outputPath += ".zip"
+			err = writeZippedPDF(write, outputPath, app.buildTime)
+		} else {
+			err = writeFile(outputPath, write)
+		}
+		if err != nil {
+			return fmt.Errorf("could not render PDF: %v", err)
+		}
+		if app.pdfInfoDump {
+			err = dumpPDFInfo(outputPath, app.zipOutput)
+			if err != nil {
+				return err
 			}
 		}
-		imageOpts := getImageOptions(imageBytes, card)
-		if (imageOpts == gofpdf.ImageOptions{}) {
-			_ = os.Remove(filepath.Join(cache.Path, cacheImageFolder, card.ImagePath))
+		written := summaryPages + len(part)*sides
+		countLog(written).info("wrote %d pages to %s", written, outputPath)
+		firstPage += len(part) * sides
+	}
+
+	if app.imageProc.enabled() {
+		logInfo("processed image payload from %d KB to %d KB", sizeBefore/1024, sizeAfter/1024)
+	}
+
+	return nil
+}
+
+// partFileName inserts a part number before the extension of outputPath,
+// e.g. "deck.pdf" becomes "deck-part2.pdf".
+func partFileName(outputPath string, part int) string {
+	ext := filepath.Ext(outputPath)
+	return fmt.Sprintf("%s-part%d%s", strings.TrimSuffix(outputPath, ext), part, ext)
+}
+
+// tocEntry locates one copy of a card in a PDF.  Page, row and column count
+// from 1.
+type tocEntry struct {
+	OctgnID string `json:"octgn_id"`
+	Name    string `json:"name"`
+	Page    int    `json:"page"`
+	Row     int    `json:"row"`
+	Col     int    `json:"col"`
+	Copy    int    `json:"copy"`
+}
+
+// tableOfContents lists the position of every card on the given pages.
+// Copies are numbered using and updating the counts in copies, so numbering
+// continues across the parts of a split output.
+func tableOfContents(pages [][]XMLCard, cols int, sides int, skip int, copies map[string]int) []tocEntry {
+	toc := make([]tocEntry, 0)
+	for p, page := range pages {
+		for i, card := range page {
+			copies[card.OctgnID]++
+			toc = append(toc, tocEntry{
+				OctgnID: card.OctgnID,
+				Name:    card.Name,
+				Page:    skip + p*sides + 1,
+				Row:     i/cols + 1,
+				Col:     i%cols + 1,
+				Copy:    copies[card.OctgnID],
+			})
+		}
+	}
+	return toc
+}
+
+func writeTOC(path string, toc []tocEntry) error {
+	data, err := json.MarshalIndent(toc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// tocFileName replaces the extension of outputPath with "-toc.json", e.g.
+// "deck.pdf" becomes "deck-toc.json".
+func tocFileName(outputPath string) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + "-toc.json"
+}
+
+// outputGroup is a set of cards written to a single output file.
+type outputGroup struct {
+	name string // for display, e.g. in the footer
+	path string
+	deck []XMLCard
+}
+
+// outputGroups splits the deck into the output files to write: either the
+// whole deck, or one file per non-empty section in deck order.
+func (app *App) outputGroups() []outputGroup {
+	name := app.deckTitle()
+	if !app.splitBySection && app.sectionsDir == "" {
+		return []outputGroup{{name: name, path: app.outputFile, deck: app.deck}}
+	}
+
+	var groups []outputGroup
+	index := make(map[string]int)
+	for _, card := range app.deck {
+		i, ok := index[card.Section]
+		if !ok {
+			i = len(groups)
+			index[card.Section] = i
+			groups = append(groups, outputGroup{
+				name: name + " - " + card.Section,
+				path: app.sectionPath(card.Section),
+			})
+		}
+		groups[i].deck = append(groups[i].deck, card)
+	}
+	return groups
+}
+
+// deckTitle names the deck after its input file, or else after the
+// encounter sets or cards it is made of.
+func (app *App) deckTitle() string {
+	name := deckName(app.inputFile)
+	if app.inputFile == "" {
+		name = strings.Join(app.encounterSets, ", ")
+	}
+	if name == "" {
+		name = namedCardsSectionName
+	}
+	return name
+}
+
+// autoOutputPath returns the output file in dir named after the deck.  A
+// number is added, as in "deck-2.pdf", to avoid overwriting an earlier
+// output unless --overwrite is set, or another output of this run.
+func (app *App) autoOutputPath(dir string) string {
+	base := sanitizeFileName(app.deckTitle())
+	ext := "." + app.format
+	outputPath := filepath.Join(dir, base+ext)
+	for n := 2; app.usedOutputs[outputPath] || !app.overwrite && app.outputExists(outputPath); n++ {
+		outputPath = filepath.Join(dir, fmt.Sprintf("%s-%d%s", base, n, ext))
+	}
+	return outputPath
+}
+
+// outputExists reports whether anything would be written over by using
+// outputPath as the output file.  For outputs written to several files,
+// only the first is checked.
+func (app *App) outputExists(outputPath string) bool {
+	names := []string{outputPath}
+	if app.zipOutput {
+		names = append(names, outputPath+".zip")
+	}
+	if app.format == "png" {
+		names = append(names, strings.TrimSuffix(outputPath, filepath.Ext(outputPath))+"-001.png")
+	}
+	if app.splitEvery > 0 {
+		names = append(names, partFileName(outputPath, 1))
+	}
+	for _, name := range names {
+		if _, err := os.Stat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sectionPath is the output file for a section: in the --sections-as-files
+// directory if set, or else next to the output file.
+func (app *App) sectionPath(section string) string {
+	if app.sectionsDir != "" {
+		return filepath.Join(app.sectionsDir, sanitizeFileName(section)+"."+app.format)
+	}
+	return sectionFileName(app.outputFile, section)
+}
+
+// sectionFileName inserts a sanitized section name before the extension of
+// outputPath, e.g. "deck.pdf" becomes "deck-Hero.pdf".
+func sectionFileName(outputPath string, section string) string {
+	ext := filepath.Ext(outputPath)
+	return strings.TrimSuffix(outputPath, ext) + "-" + sanitizeFileName(section) + ext
+}
+
+// sanitizeFileName replaces anything but letters, digits, dots, dashes and
+// underscores with underscores so the name is safe on any filesystem.
+func sanitizeFileName(name string) string {
+	clean := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.TrimSpace(name))
+	clean = strings.Trim(clean, ".")
+	if clean == "" {
+		return "unnamed"
+	}
+	return clean
+}
+
+// ReportMissingImages writes the OCTGN IDs of all skipped cards, one per
+// line, if a report file was requested.
+func (app *App) ReportMissingImages() {
+	if app.err != nil || app.missingReport == "" {
+		return
+	}
+	defer app.failed(stageOutput)
+
+	seen := make(map[string]bool)
+	var buf bytes.Buffer
+	for _, id := range app.missing {
+		if seen[id] {
 			continue
 		}
-		pdf.RegisterImageOptionsReader(card.ImagePath, imageOpts, bytes.NewReader(imageBytes))
-		deckWithValidImages = append(deckWithValidImages, card)
+		seen[id] = true
+		fmt.Fprintln(&buf, id)
+	}
+
+	app.err = ioutil.WriteFile(app.missingReport, buf.Bytes(), 0644)
+	if app.err != nil {
+		return
+	}
+	countLog(len(seen)).info("wrote %d missing card IDs to %s", len(seen), app.missingReport)
+}
+
+// deckName derives a human-readable deck name from the input file name.
+func deckName(inputFile string) string {
+	if inputFile == stdinInput {
+		return ""
+	}
+	base := filepath.Base(inputFile)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// setPageBoxes sets the trim and art boxes of every page to the card grid
+// and the bleed box to the grid plus bleed millimeters on each side, within
+// the page.  The crop box is the whole page.
+func setPageBoxes(pdf *gofpdf.Fpdf, layout Layout, bleed float64) {
+	page := Rect{W: layout.PageWidth, H: layout.PageHeight}
+	trim := layout.GridRect()
+	bleedBox := layout.BleedRect(bleed)
+
+	// Page boxes are measured from the bottom of the page.
+	set := func(box string, r Rect) {
+		pdf.SetPageBox(box, r.X, layout.PageHeight-r.Y-r.H, r.W, r.H)
+	}
+	set("crop", page)
+	set("trim", trim)
+	set("art", trim)
+	set("bleed", bleedBox)
+}
+
+// footerInfo describes where a PDF's pages fall in the overall output.
+type footerInfo struct {
+	Name       string
+	Date       time.Time
+	FirstPage  int // number of this PDF's first page in the overall sequence
+	TotalPages int
+	SkipPages  int // of this PDF, such as the --summary, with no footer
+	Part       int
+	Parts      int
+	FontScale  float64
+}
+
+// setFooter installs a footer that prints the deck name, generation date and
+// page numbering centered in the space below the card grid.  It fails if the
+// bottom margin is too small to hold the text without overlapping cards.
+func setFooter(pdf *gofpdf.Fpdf, layout Layout, info footerInfo) error {
+	footerFontSize := 6.0 * info.FontScale
+
+	pdf.SetFont("Helvetica", "", footerFontSize)
+	_, lineHeight := pdf.GetFontSize()
+
+	gridBottom := layout.MarginTop + layout.GridHeight()
+	space := layout.PageHeight - gridBottom
+	if space < lineHeight {
+		return fmt.Errorf("bottom margin too small for footer (%.1fmm < %.1fmm)", space, lineHeight)
+	}
+	y := gridBottom + (space-lineHeight)/2
+
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	date := info.Date.Format("2006-01-02")
+	pdf.SetFooterFunc(func() {
+		if pdf.PageNo() <= info.SkipPages {
+			return
+		}
+		page := info.FirstPage + pdf.PageNo() - 1 - info.SkipPages
+		text := fmt.Sprintf("%s - %s - page %d of %d", info.Name, date, page, info.TotalPages)
+		if info.Parts > 1 {
+			text += fmt.Sprintf(" - part %d of %d", info.Part, info.Parts)
+		}
+		pdf.SetFont("Helvetica", "", footerFontSize)
+		pdf.SetXY(0, y)
+		pdf.CellFormat(layout.PageWidth, lineHeight, tr(text), "", 0, "C", false, 0, "")
+	})
+
+	return nil
+}
+
+// imageCheck records whether each card's cached image is usable, judged by
+// sniffing just the start of the file, so pages can be laid out before any
+// image is read in full.
+type imageCheck struct {
+	cache    *configdir.Config
+	readOnly bool
+	valid    map[string]bool
+
+	// skipped lists OCTGN IDs of cards whose images were unusable.
+	skipped []string
+}
+
+func newImageCheck(cache *configdir.Config, readOnly bool) *imageCheck {
+	return &imageCheck{cache: cache, readOnly: readOnly, valid: make(map[string]bool)}
+}
+
+// usable returns the cards whose images are usable.
+func (ic *imageCheck) usable(cards []XMLCard) ([]XMLCard, error) {
+	usable := make([]XMLCard, 0, len(cards))
+	for _, card := range cards {
+		valid, seen := ic.valid[card.ImagePath]
+		if !seen {
+			var err error
+			valid, err = ic.check(card)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", card.ImagePath, err)
+			}
+			ic.valid[card.ImagePath] = valid
+		}
+		if valid {
+			usable = append(usable, card)
+		} else {
+			ic.skipped = append(ic.skipped, card.OctgnID)
+		}
 	}
+	return usable, nil
+}
 
-	return deckWithValidImages, nil
+func (ic *imageCheck) check(card XMLCard) (bool, error) {
+	imagePath := imageFile(ic.cache, card)
+	head, err := readFileHead(imagePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			imageLog(card.ImagePath).info("no cached image for %s (skipping it)", card.Card)
+			return false, nil
+		}
+		return false, err
+	}
+	if (getImageOptions(head, card) == gofpdf.ImageOptions{}) {
+		if !card.Override && !ic.readOnly {
+			_ = os.Remove(imagePath)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// readFileHead returns the start of a file, as much as
+// http.DetectContentType considers.
+func readFileHead(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// imageFile is the full path of a card's image file.
+func imageFile(cache *configdir.Config, card XMLCard) string {
+	if card.Override {
+		return card.ImagePath
+	}
+	return filepath.Join(cache.Path, cacheImageFolder, card.ImagePath)
+}
+
+// pdfImages registers card images with a PDF lazily, right before the page
+// that first uses them, so only about a page's worth of image bytes is read
+// from the cache at a time.  Each image is read at most once.
+type pdfImages struct {
+	pdf      *gofpdf.Fpdf
+	cache    *configdir.Config
+	readOnly bool
+	proc     ImageProcessing
+
+	// noDedup registers an image for every card drawn, under names like
+	// Core/001.png#3, instead of once per file.
+	noDedup   bool
+	instances int
+
+	registered map[string]bool
+
+	// readFile reads images from the cache.
+	readFile func(name string) ([]byte, error)
+
+	// cardAspect is the width over the height of a card slot; images far
+	// from it are warned about, or are errors with strictAspect.
+	cardAspect   float64
+	strictAspect bool
+
+	sizeBefore int
+	sizeAfter  int
+}
+
+func newPDFImages(pdf *gofpdf.Fpdf, cache *configdir.Config, readOnly bool, proc ImageProcessing, noDedup bool) *pdfImages {
+	return &pdfImages{
+		pdf:        pdf,
+		cache:      cache,
+		readOnly:   readOnly,
+		proc:       proc,
+		noDedup:    noDedup,
+		registered: make(map[string]bool),
+		readFile:   ioutil.ReadFile,
+	}
+}
+
+// addImagesToPdf registers any not-yet-registered images for the given
+// cards, which must already have passed an imageCheck, and returns the cards
+// with ImagePath set to the name each image was registered under.  Images are
+// read and prepared concurrently but registered serially in deck order, since
+// gofpdf isn't safe for concurrent use and a stable order keeps output
+// reproducible.
+func (pi *pdfImages) addImagesToPdf(cards []XMLCard) ([]XMLCard, error) {
+	// Collect images not registered before, in deck order.
+	var pending []XMLCard
+	var names []string
+	queued := make(map[string]bool)
+	drawn := make([]XMLCard, len(cards))
+	copy(drawn, cards)
+	for i, card := range cards {
+		name := card.ImagePath
+		if pi.noDedup {
+			pi.instances++
+			name = fmt.Sprintf("%s#%d", card.ImagePath, pi.instances)
+			drawn[i].ImagePath = name
+		}
+		if !pi.registered[name] && !queued[name] {
+			queued[name] = true
+			pending = append(pending, card)
+			names = append(names, name)
+		}
+	}
+
+	prepared := make([]preparedImage, len(pending))
+	work := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < runtime.NumCPU() && w < len(pending); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				prepared[i] = pi.prepare(pending[i])
+			}
+		}()
+	}
+	for i := range pending {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	for i, card := range pending {
+		p := prepared[i]
+		if p.err != nil {
+			return nil, fmt.Errorf("%s: %v", card.ImagePath, p.err)
+		}
+		if !p.valid {
+			return nil, fmt.Errorf("%s: cached image became unusable", card.ImagePath)
+		}
+		if pi.cardAspect > 0 {
+			err := checkAspect(p.data, pi.cardAspect, pi.strictAspect, card)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", card.ImagePath, err)
+			}
+		}
+		pi.sizeBefore += p.origSize
+		pi.sizeAfter += len(p.data)
+		pi.pdf.RegisterImageOptionsReader(names[i], p.opts, bytes.NewReader(p.data))
+		pi.registered[names[i]] = true
+	}
+
+	return drawn, nil
+}
+
+// preparedImage is a card image read from the cache and ready to register.
+type preparedImage struct {
+	data     []byte
+	opts     gofpdf.ImageOptions
+	origSize int
+	valid    bool
+	err      error
+}
+
+func (pi *pdfImages) prepare(card XMLCard) preparedImage {
+	return prepareImage(pi.cache, pi.readOnly, pi.proc, card, pi.readFile)
+}
+
+// prepareImage reads a card's image from the cache with read, checks its
+// type and applies any image processing.  The result is not valid if the image is
+// missing or unsupported.  Unsupported files are removed from the cache
+// unless it is read-only.
+func prepareImage(cache *configdir.Config, readOnly bool, proc ImageProcessing, card XMLCard, read func(string) ([]byte, error)) preparedImage {
+	imageBytes, err := read(imageFile(cache, card))
+	if err != nil {
+		if os.IsNotExist(err) {
+			imageLog(card.ImagePath).info("no cached image for %s (skipping it)", card.Card)
+			return preparedImage{}
+		}
+		return preparedImage{err: err}
+	}
+	imageOpts := getImageOptions(imageBytes, card)
+	if (imageOpts == gofpdf.ImageOptions{}) {
+		if !card.Override && !readOnly {
+			_ = os.Remove(imageFile(cache, card))
+		}
+		return preparedImage{}
+	}
+	origSize := len(imageBytes)
+	if imageOpts.ImageType == "GIF" {
+		imageBytes, err = gifToPNG(imageBytes)
+		if err != nil {
+			imageLog(card.ImagePath).info("could not convert GIF image for %s (%s): %v (skipping it)", card.ImagePath, card.Card, err)
+			return preparedImage{}
+		}
+		imageOpts = gofpdf.ImageOptions{ImageType: "PNG"}
+	}
+	imageBytes, imageOpts = processImage(imageBytes, imageOpts, proc, card.ImagePath)
+	return preparedImage{data: imageBytes, opts: imageOpts, origSize: origSize, valid: true}
 }
 
 func getImageOptions(bytes []byte, c XMLCard) gofpdf.ImageOptions {
@@ -338,73 +2091,441 @@ func getImageOptions(bytes []byte, c XMLCard) gofpdf.ImageOptions {
 		return gofpdf.ImageOptions{ImageType: "JPEG"}
 	case "image/png":
 		return gofpdf.ImageOptions{ImageType: "PNG"}
+	case "image/gif":
+		return gofpdf.ImageOptions{ImageType: "GIF"}
 	default:
-		log.Printf("unsupported image type for %s (%s): %s (skipping it)", c.ImagePath, c.Card, mimeType)
+		imageLog(c.ImagePath).info("unsupported image type for %s (%s): %s (skipping it)", c.ImagePath, c.Card, mimeType)
 		return gofpdf.ImageOptions{}
 	}
 }
 
-func renderPDF(pdf *gofpdf.Fpdf, deck []XMLCard, outputPath string) error {
-
-	images := make([]string, 0)
-	for _, card := range deck {
-		for i := 0; i < card.Quantity; i++ {
-			images = append(images, card.ImagePath)
+// renderPDF registers images and draws all pages of a PDF, ready for
+// output.  Unless sectionStarts finds nothing to mark, the outline has a
+// bookmark titled name on the first page and under it one for each section,
+// on the page where its cards start.
+func renderPDF(pdf *gofpdf.Fpdf, images *pdfImages, layout Layout, opts RenderOptions, name string, pages [][]XMLCard) error {
+	if opts.Back != nil {
+		backs, err := images.addImagesToPdf([]XMLCard{*opts.Back})
+		if err != nil {
+			return err
+		}
+		opts.Back = &backs[0]
+	}
+	if opts.Filler != nil {
+		fillers, err := images.addImagesToPdf([]XMLCard{*opts.Filler})
+		if err != nil {
+			return err
 		}
+		opts.Filler = &fillers[0]
 	}
 
-	var batch []string
-	for len(images) > 0 {
-		batch, images = splitAt(9, images)
-		err := renderSinglePage(pdf, batch)
+	starts := sectionStarts(pages, name)
+	for i, page := range pages {
+		// Register images just before the page that first needs them.
+		page, err := images.addImagesToPdf(page)
+		if err != nil {
+			return err
+		}
+		err = renderSinglePage(pdf, layout, opts, page)
 		if err != nil {
 			return fmt.Errorf("could not assemble PDF: %v", err)
 		}
+		if starts != nil {
+			if i == 0 {
+				pdf.Bookmark(name, 0, 0)
+			}
+			for _, section := range starts[i] {
+				pdf.Bookmark(section, 1, 0)
+			}
+		}
+		if opts.Back != nil {
+			n := len(page)
+			if opts.Filler != nil {
+				n = layout.CardsPerPage()
+			}
+			renderBackPage(pdf, layout, opts, n)
+		}
+	}
+
+	return nil
+}
+
+// sectionStarts returns the names of the sections whose first card is on
+// each page, or nil if no card belongs to a named section or the only one
+// is named like the PDF, as for --card.
+func sectionStarts(pages [][]XMLCard, name string) [][]string {
+	starts := make([][]string, len(pages))
+	seen := make(map[string]bool)
+	for i, page := range pages {
+		for _, card := range page {
+			if card.Section != "" && !seen[card.Section] {
+				seen[card.Section] = true
+				starts[i] = append(starts[i], card.Section)
+			}
+		}
+	}
+	if len(seen) == 0 || (len(seen) == 1 && seen[name]) {
+		return nil
+	}
+	return starts
+}
+
+// writeFile creates path and fills it with write.
+func writeFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
+	return err
+}
 
-	err := pdf.OutputFileAndClose(outputPath)
+// writeZippedPDF writes a PDF as proxies.pdf in a new ZIP archive.
+func writeZippedPDF(write func(io.Writer) error, zipPath string, modified time.Time) error {
+	f, err := os.Create(zipPath)
 	if err != nil {
-		return fmt.Errorf("could not render PDF: %v", err)
+		return err
 	}
+	defer f.Close()
 
-	return nil
+	zw := zip.NewWriter(f)
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     "proxies.pdf",
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	err = write(w)
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
 }
 
-func splitAt(n int, xs []string) ([]string, []string) {
+// expandDeck returns the deck with one entry per copy of each card, ordered
+// according to the card grouping strategy.
+func (app *App) expandDeck(deck []XMLCard) []XMLCard {
+	if app.grouping == "dispersed" {
+		return disperseCopies(deck)
+	}
+	return expandQuantities(deck)
+}
+
+// expandQuantities returns a list with one entry per copy of each card.
+func expandQuantities(deck []XMLCard) []XMLCard {
+	cards := make([]XMLCard, 0)
+	for _, card := range deck {
+		for i := 0; i < card.Quantity; i++ {
+			cards = append(cards, card)
+		}
+	}
+	return cards
+}
+
+// repeatCards repeats each card n times in place, for --copies.
+func repeatCards(cards []XMLCard, n int) []XMLCard {
+	if n <= 1 {
+		return cards
+	}
+	repeated := make([]XMLCard, 0, len(cards)*n)
+	for _, card := range cards {
+		for i := 0; i < n; i++ {
+			repeated = append(repeated, card)
+		}
+	}
+	return repeated
+}
+
+// repeatPages repeats the whole run of pages n times, for --copies with
+// --collate.
+func repeatPages(pages [][]XMLCard, n int) [][]XMLCard {
+	repeated := make([][]XMLCard, 0, len(pages)*n)
+	for i := 0; i < n; i++ {
+		repeated = append(repeated, pages...)
+	}
+	return repeated
+}
+
+// disperseCopies returns a list with one entry per copy of each card, taking
+// one copy of every card per round so copies of the same card land on
+// different pages where possible.
+func disperseCopies(deck []XMLCard) []XMLCard {
+	cards := make([]XMLCard, 0)
+	for round := 0; ; round++ {
+		added := false
+		for _, card := range deck {
+			if round < card.Quantity {
+				cards = append(cards, card)
+				added = true
+			}
+		}
+		if !added {
+			return cards
+		}
+	}
+}
+
+// paginate fills pages of up to perPage cards.  Cards are passed through
+// usable in batches first, so any it drops are replaced by later cards rather
+// than leaving holes in a page.
+func paginate(cards []XMLCard, perPage int, usable func([]XMLCard) ([]XMLCard, error)) ([][]XMLCard, error) {
+	var pages [][]XMLCard
+	var page, batch []XMLCard
+	for len(cards) > 0 {
+		batch, cards = splitAt(perPage-len(page), cards)
+		var err error
+		batch, err = usable(batch)
+		if err != nil {
+			return nil, err
+		}
+		page = append(page, batch...)
+		if len(page) < perPage && len(cards) > 0 {
+			continue
+		}
+		if len(page) > 0 {
+			pages = append(pages, page)
+		}
+		page = nil
+	}
+	return pages, nil
+}
+
+func splitAt(n int, xs []XMLCard) ([]XMLCard, []XMLCard) {
 	if len(xs) < n {
 		n = len(xs)
 	}
 	return xs[0:n], xs[n:]
 }
 
-func renderSinglePage(pdf gofpdf.Pdf, images []string) error {
-	if len(images) > 9 {
-		return fmt.Errorf("too many images to render (%d > 9)", len(images))
+// splitPages groups pages into parts of at most n pages each, or a single
+// part if n is zero.
+func splitPages(n int, pages [][]XMLCard) [][][]XMLCard {
+	if n <= 0 {
+		return [][][]XMLCard{pages}
+	}
+	var parts [][][]XMLCard
+	for len(pages) > n {
+		parts = append(parts, pages[:n])
+		pages = pages[n:]
+	}
+	return append(parts, pages)
+}
+
+func renderSinglePage(pdf gofpdf.Pdf, layout Layout, opts RenderOptions, cards []XMLCard) error {
+	if len(cards) > layout.CardsPerPage() {
+		return fmt.Errorf("too many images to render (%d > %d)", len(cards), layout.CardsPerPage())
 	}
 
 	pdf.AddPage()
 
-	var cardWidth = 63.5
-	var cardHeight = 88.0
-	var leftPadding = 4.0
-	var spacer = 4.0
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	if opts.Stamp != "" {
+		err := renderStamp(pdf, layout, tr(opts.Stamp), opts.FontScale)
+		if err != nil {
+			return err
+		}
+	}
+	slots := layout.Slots()
+	if len(cards) < len(slots) && opts.Filler == nil {
+		slots = slots[:len(cards)]
+	}
+	renderFrames(pdf, slots, layout.Border, opts.FrameColor)
+	for i, slot := range slots {
+		if i >= len(cards) {
+			renderImage(pdf, opts.Filler.ImagePath, slot, opts)
+			continue
+		}
+		card := cards[i]
 
-	for i := 0; i < 3; i++ {
-		for j := 0; j < 3; j++ {
-			if len(images) == 0 {
-				return nil
-			}
-			fi, fj := float64(i), float64(j)
+		v := renderImage(pdf, card.ImagePath, slot, opts)
+		if opts.LinkBase != "" && card.Code != "" {
+			pdf.LinkString(v.X, v.Y, v.W, v.H, opts.LinkBase+card.Code)
+		}
+		if opts.Watermark.Text != "" {
+			renderWatermark(pdf, tr, slot, opts.Watermark, opts.FontScale)
+		}
+		if layout.LabelHeight > 0 {
+			y := slot.Y + slot.H + layout.Border
+			renderLabel(pdf, tr, card.Name, opts, slot.X, y, slot.W, layout.LabelHeight-layout.Border)
+		}
+	}
+	if opts.CutLines {
+		renderCutLines(pdf, layout, opts.Bleed)
+	}
+
+	return nil
+}
+
+// Width of --cut-lines, in millimeters.
+const cutLineWidth = 0.1
 
-			pdf.ImageOptions(
-				images[0],
-				leftPadding+spacer*(fj+1)+cardWidth*fj,
-				spacer*(fi+1)+cardHeight*fi,
-				cardWidth, cardHeight, false, gofpdf.ImageOptions{}, 0, "",
-			)
-			images = images[1:]
+// renderCutLines draws thin lines from edge to edge of the page along the
+// grid edges and gutters.  If bleed is positive, only the parts in the
+// margins outside the bleed box are drawn.
+func renderCutLines(pdf gofpdf.Pdf, layout Layout, bleed float64) {
+	pdf.SetDrawColor(0, 0, 0)
+	pdf.SetLineWidth(cutLineWidth)
+	xs, ys := layout.CutLines()
+	if bleed <= 0 {
+		for _, x := range xs {
+			pdf.Line(x, 0, x, layout.PageHeight)
+		}
+		for _, y := range ys {
+			pdf.Line(0, y, layout.PageWidth, y)
 		}
+		return
+	}
+	b := layout.BleedRect(bleed)
+	for _, x := range xs {
+		pdf.Line(x, 0, x, b.Y)
+		pdf.Line(x, b.Y+b.H, x, layout.PageHeight)
+	}
+	for _, y := range ys {
+		pdf.Line(0, y, b.X, y)
+		pdf.Line(b.X+b.W, y, layout.PageWidth, y)
 	}
+}
+
+// renderStamp prints small gray text rotated to run up the middle of the
+// right margin, outside the card grid.
+func renderStamp(pdf gofpdf.Pdf, layout Layout, text string, fontScale float64) error {
+	const stampFontSize = 4.0
+
+	pdf.SetFont("Helvetica", "", stampFontSize*fontScale)
+	_, lineHeight := pdf.GetFontSize()
+
+	gridRight := layout.MarginLeft + layout.GridWidth()
+	space := layout.PageWidth - gridRight
+	if space < lineHeight {
+		return fmt.Errorf("right margin too small for stamp (%.1fmm < %.1fmm)", space, lineHeight)
+	}
+
+	// Rotating 90 degrees counterclockwise about the start of the baseline
+	// makes the text run upward with its glyphs extending to the left.
+	x := gridRight + (space+lineHeight)/2
+	y := (layout.PageHeight + pdf.GetStringWidth(text)) / 2
+
+	pdf.SetTextColor(128, 128, 128)
+	pdf.TransformBegin()
+	pdf.TransformRotate(90, x, y)
+	pdf.Text(x, y, text)
+	pdf.TransformEnd()
+	pdf.SetTextColor(0, 0, 0)
 
 	return nil
 }
+
+// renderImage draws a registered image in a card slot, scaled as
+// opts.ImageFit says, with any drop shadow beneath and border around the
+// visible part, and its corners rounded by opts.CornerRadius.  It returns
+// the visible part.
+func renderImage(pdf gofpdf.Pdf, name string, slot Rect, opts RenderOptions) Rect {
+	r := slot
+	if info := pdf.GetImageInfo(name); info != nil {
+		r = slot.Fit(info.Width(), info.Height(), opts.ImageFit)
+	}
+	v := r.Intersect(slot)
+	if opts.Shadow {
+		renderShadow(pdf, v.X, v.Y, v.W, v.H)
+	}
+	clip := opts.ImageFit == fitCover || opts.CornerRadius > 0
+	if clip {
+		clipCorners(pdf, v, opts.CornerRadius, false)
+	}
+	// Cropped images can start left of the page.
+	imageOpts := gofpdf.ImageOptions{AllowNegativePosition: true}
+	pdf.ImageOptions(name, r.X, r.Y, r.W, r.H, false, imageOpts, 0, "")
+	if clip {
+		pdf.ClipEnd()
+	}
+	if opts.BorderWidth > 0 {
+		renderBorder(pdf, v, opts.BorderWidth, opts.BorderColor, opts.CornerRadius)
+	}
+	return v
+}
+
+// renderFrames fills a frame of the given width around each slot.  All
+// frames go down before any image, so where they overlap they merge
+// without covering a neighboring card.
+func renderFrames(pdf gofpdf.Pdf, slots []Rect, width float64, c hexColor) {
+	if width <= 0 {
+		return
+	}
+	pdf.SetFillColor(c.R, c.G, c.B)
+	for _, slot := range slots {
+		f := slot.Grow(width)
+		pdf.Rect(f.X, f.Y, f.W, f.H, "F")
+	}
+}
+
+// clipCorners starts clipping to r with corners rounded by radius, which is
+// reduced if r is too small for it, and strokes the clipping path if
+// outline is set.  The caller ends the clipping with ClipEnd.
+func clipCorners(pdf gofpdf.Pdf, r Rect, radius float64, outline bool) {
+	radius = math.Min(radius, math.Min(r.W, r.H)/2)
+	if radius <= 0 {
+		pdf.ClipRect(r.X, r.Y, r.W, r.H, outline)
+		return
+	}
+	pdf.ClipRoundedRect(r.X, r.Y, r.W, r.H, radius, outline)
+}
+
+// renderBorder strokes a rectangle, with corners rounded by radius, centered
+// on the edge of r.
+func renderBorder(pdf gofpdf.Pdf, r Rect, width float64, c hexColor, radius float64) {
+	pdf.SetDrawColor(c.R, c.G, c.B)
+	pdf.SetLineWidth(width)
+	if radius <= 0 {
+		pdf.Rect(r.X, r.Y, r.W, r.H, "D")
+		return
+	}
+	// The Pdf interface has no RoundedRect, so outline a rounded clip.
+	clipCorners(pdf, r, radius, true)
+	pdf.ClipEnd()
+}
+
+// renderShadow draws a translucent gray rectangle offset down and to the
+// right of the given card rectangle.
+func renderShadow(pdf gofpdf.Pdf, x, y, w, h float64) {
+	const offset = 1.0
+
+	pdf.SetAlpha(0.5, "Normal")
+	pdf.SetFillColor(64, 64, 64)
+	pdf.Rect(x+offset, y+offset, w, h, "F")
+	pdf.SetAlpha(1.0, "Normal")
+}
+
+// fitText shortens text with an ellipsis until, translated by tr, it is at
+// most w wide in the current font.  The result is not translated.
+func fitText(pdf gofpdf.Pdf, tr func(string) string, text string, w float64) string {
+	runes := []rune(text)
+	fitted := text
+	for len(runes) > 0 && pdf.GetStringWidth(tr(fitted)) > w {
+		runes = runes[:len(runes)-1]
+		fitted = strings.TrimSpace(string(runes)) + "…"
+	}
+	return fitted
+}
+
+// renderLabel prints text centered in the given box, truncating it with an
+// ellipsis if it is too wide to fit.
+func renderLabel(pdf gofpdf.Pdf, tr func(string) string, text string, opts RenderOptions, x, y, w, h float64) {
+	const labelFontSize = 7.0
+
+	c := opts.LabelColor
+	pdf.SetFont("Helvetica", "", labelFontSize*opts.FontScale)
+	label := tr(fitText(pdf, tr, text, w))
+	pdf.SetTextColor(c.R, c.G, c.B)
+	pdf.SetXY(x, y)
+	pdf.CellFormat(w, h, label, "", 0, "CM", false, 0, "")
+	pdf.SetTextColor(0, 0, 0)
+}
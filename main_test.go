@@ -0,0 +1,252 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+func TestFetchImagesOncePerImage(t *testing.T) {
+	site := newFakeSite(map[string][]byte{
+		"/bundles/cards/01001.png": []byte("Aragorn"),
+		"/bundles/cards/01004.png": []byte("Gimli"),
+		"/bundles/cards/01073.png": []byte("Gandalf"),
+	})
+	defer site.Close()
+	app, cleanup := newTestApp(t, site.URL)
+	defer cleanup()
+
+	// The same cards in several sections, as in a deck and its sideboard.
+	deck := []XMLCard{
+		{Card: "Aragorn", Quantity: 1, ImagePath: "01001.png", Section: "Hero"},
+		{Card: "Gimli", Quantity: 1, ImagePath: "01004.png", Section: "Hero"},
+		{Card: "Gandalf", Quantity: 3, ImagePath: "01073.png", Section: "Ally"},
+		{Card: "Gandalf", Quantity: 2, ImagePath: "01073.png", Section: "Sideboard"},
+		{Card: "Aragorn", Quantity: 1, ImagePath: "01001.png", Section: "Sideboard"},
+	}
+	for run := 1; run <= 2; run++ {
+		failed, err := app.fetchImages(deck)
+		if err != nil || len(failed) > 0 {
+			t.Fatalf("run %d: fetchImages: %v %v", run, failed, err)
+		}
+		// The second run finds every image cached.
+		for _, name := range []string{"01001.png", "01004.png", "01073.png"} {
+			if n := site.count("/bundles/cards/" + name); n != 1 {
+				t.Errorf("run %d: %s fetched %d times, want 1", run, name, n)
+			}
+		}
+	}
+}
+
+// testGIF returns a 2x1 GIF with an opaque red pixel and a transparent one.
+func testGIF(t *testing.T) []byte {
+	palette := color.Palette{color.RGBA{R: 255, A: 255}, color.RGBA{}}
+	img := image.NewPaletted(image.Rect(0, 0, 2, 1), palette)
+	img.SetColorIndex(1, 0, 1)
+	var buf bytes.Buffer
+	err := gif.Encode(&buf, img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImageTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string // image type, or "" if unsupported
+	}{
+		{"jpeg", testImage(t, "jpeg", 4, 6, color.NRGBA{R: 10, G: 20, B: 30, A: 255}), "JPEG"},
+		{"png", testImage(t, "png", 4, 6, color.NRGBA{R: 10, G: 20, B: 30, A: 128}), "PNG"},
+		{"gif", testGIF(t), "GIF"},
+		{"webp", []byte("RIFF\x1a\x00\x00\x00WEBPVP8 "), ""},
+		{"html", []byte("<html><body>Not Found</body></html>"), ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		opts := getImageOptions(tt.data, XMLCard{Card: tt.name, ImagePath: tt.name})
+		if opts != (gofpdf.ImageOptions{ImageType: tt.want}) {
+			t.Errorf("%s: image options %+v, want type %q", tt.name, opts, tt.want)
+		}
+
+		converted, err := gifToPNG(tt.data)
+		if tt.want != "GIF" {
+			if err == nil {
+				t.Errorf("%s: gifToPNG succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: gifToPNG: %v", tt.name, err)
+		}
+		if opts := getImageOptions(converted, XMLCard{}); opts.ImageType != "PNG" {
+			t.Errorf("%s: converted image has type %q", tt.name, opts.ImageType)
+		}
+		img, err := png.Decode(bytes.NewReader(converted))
+		if err != nil {
+			t.Fatalf("%s: converted image doesn't decode: %v", tt.name, err)
+		}
+		if _, _, _, a := img.At(0, 0).RGBA(); a != 0xffff {
+			t.Errorf("%s: opaque pixel has alpha %#x", tt.name, a)
+		}
+		if _, _, _, a := img.At(1, 0).RGBA(); a != 0 {
+			t.Errorf("%s: transparent pixel has alpha %#x", tt.name, a)
+		}
+	}
+}
+
+// imageReads counts the reads of each cache file by a pdfImages, and notes
+// how many pages had been added to the PDF at the first read of each.
+type imageReads struct {
+	mu    sync.Mutex
+	count map[string]int
+	page  map[string]int
+}
+
+func countImageReads(images *pdfImages) *imageReads {
+	r := &imageReads{count: make(map[string]int), page: make(map[string]int)}
+	read := images.readFile
+	images.readFile = func(name string) ([]byte, error) {
+		r.mu.Lock()
+		r.count[name]++
+		if r.count[name] == 1 {
+			r.page[name] = images.pdf.PageNo()
+		}
+		r.mu.Unlock()
+		return read(name)
+	}
+	return r
+}
+
+// bigTestDeck returns 200 cards using 40 cached images.  Some images are
+// first used on late pages, and some are used again pages later.
+func bigTestDeck(t testing.TB, manifest *cacheManifest) []XMLCard {
+	unique := testCards(t, manifest, 40)
+	var deck []XMLCard
+	for i := 0; i < 200; i++ {
+		if i < 100 {
+			deck = append(deck, unique[i/5])
+		} else {
+			deck = append(deck, unique[i%40])
+		}
+	}
+	return deck
+}
+
+func TestRenderPDFRegistersImagesByPage(t *testing.T) {
+	app, cleanup := newTestApp(t, "")
+	defer cleanup()
+	layout := pageSizePresets["us-letter"]
+	pages, err := paginate(bigTestDeck(t, app.manifest), layout.CardsPerPage(), func(cards []XMLCard) ([]XMLCard, error) {
+		return cards, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	images := newPDFImages(pdf, app.cache, false, ImageProcessing{}, false)
+	reads := countImageReads(images)
+	err = renderPDF(pdf, images, layout, RenderOptions{ImageFit: fitContain}, "Deck", pages)
+	if err != nil {
+		t.Fatalf("renderPDF: %v", err)
+	}
+	if pdf.PageNo() != len(pages) || len(pages) != 23 {
+		t.Errorf("rendered %d of %d pages, want 23", pdf.PageNo(), len(pages))
+	}
+
+	// Each image is read once, just before the first page that shows it.
+	firstPage := make(map[string]int)
+	for i, page := range pages {
+		for _, card := range page {
+			if _, ok := firstPage[card.ImagePath]; !ok {
+				firstPage[card.ImagePath] = i
+			}
+		}
+	}
+	if len(reads.count) != len(firstPage) {
+		t.Errorf("read %d images, want %d", len(reads.count), len(firstPage))
+	}
+	for name, page := range firstPage {
+		path := imageFile(app.cache, XMLCard{ImagePath: name})
+		if reads.count[path] != 1 || reads.page[path] != page {
+			t.Errorf("%s read %d times, first after %d pages; want once after %d", name, reads.count[path], reads.page[path], page)
+		}
+	}
+}
+
+func BenchmarkRenderPDF(b *testing.B) {
+	app, cleanup := newTestApp(b, "")
+	defer cleanup()
+	layout := pageSizePresets["us-letter"]
+	pages, err := paginate(bigTestDeck(b, app.manifest), layout.CardsPerPage(), func(cards []XMLCard) ([]XMLCard, error) {
+		return cards, nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pdf := gofpdf.New("P", "mm", "Letter", "")
+		images := newPDFImages(pdf, app.cache, false, ImageProcessing{}, false)
+		err = renderPDF(pdf, images, layout, RenderOptions{ImageFit: fitContain}, "Deck", pages)
+		if err == nil {
+			err = pdf.Output(ioutil.Discard)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAddImagesToPdfReadsSharedImageOnce(t *testing.T) {
+	app, cleanup := newTestApp(t, "")
+	defer cleanup()
+	cached := testCards(t, app.manifest, 2)
+
+	// The same card in two sections, on one page and then on the next.
+	hero, other := cached[0], cached[1]
+	hero.OctgnID = "51223bd0-ffd1-11df-a976-0801200c9001"
+	sideboard := hero
+	sideboard.Section = "Sideboard"
+	pages := [][]XMLCard{{hero, other, sideboard}, {sideboard}}
+
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	images := newPDFImages(pdf, app.cache, false, ImageProcessing{}, false)
+	reads := countImageReads(images)
+	for _, page := range pages {
+		drawn, err := images.addImagesToPdf(page)
+		if err != nil {
+			t.Fatalf("addImagesToPdf: %v", err)
+		}
+		for i, card := range drawn {
+			if card.ImagePath != page[i].ImagePath {
+				t.Errorf("%s drawn as %s", page[i].ImagePath, card.ImagePath)
+			}
+		}
+	}
+	for _, card := range []XMLCard{hero, other} {
+		if n := reads.count[imageFile(app.cache, card)]; n != 1 {
+			t.Errorf("%s read %d times, want 1", card.ImagePath, n)
+		}
+	}
+	if len(images.registered) != 2 {
+		t.Errorf("registered %d images, want 2", len(images.registered))
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shibukawa/configdir"
+)
+
+// Name of the cache manifest file.
+const manifestName = "manifest.json"
+
+// cacheFormatVersion changes whenever the cached metadata format does, so
+// caches written by other versions are refetched instead of misread.
+const cacheFormatVersion = 4
+
+// cacheManifest records what the cache holds: when each metadata file was
+// fetched, and a checksum of each image, so corrupt files are found before
+// they reach a PDF, and when it was fetched.  It is safe for concurrent use,
+// and changes are made under the cache lock to the manifest as last saved,
+// so runs sharing the cache don't lose each other's changes.
+type cacheManifest struct {
+	FormatVersion int                       `json:"format_version"`
+	Metadata      map[string]metadataRecord `json:"metadata"` // by file name
+	Images        map[string]string         `json:"images"`   // SHA-256 by image path
+
+	// ImagesFetched is when each image was fetched, by image path.  Images
+	// cached before it was kept have no entry.
+	ImagesFetched map[string]time.Time `json:"images_fetched,omitempty"`
+
+	mu       sync.Mutex
+	cache    *configdir.Config
+	readOnly bool
+}
+
+type metadataRecord struct {
+	FetchedAt time.Time `json:"fetched_at"`
+	ETag      string    `json:"etag,omitempty"`
+}
+
+// openManifest reads the cache manifest.  A cache without a manifest, or
+// with one of another format version, gets a new manifest: its metadata is
+// refetched, and its images are kept and checksummed.
+func openManifest(cache *configdir.Config, readOnly bool) *cacheManifest {
+	m := &cacheManifest{cache: cache, readOnly: readOnly}
+	if !readOnly {
+		unlock, err := lockCache(cache)
+		if err != nil {
+			logWarn("%v", err)
+		} else {
+			defer unlock()
+		}
+	}
+	data, err := cache.ReadFile(manifestName)
+	if err == nil {
+		err = json.Unmarshal(data, m)
+	}
+	switch {
+	case err == nil && m.FormatVersion == cacheFormatVersion:
+		if m.Metadata == nil {
+			m.Metadata = make(map[string]metadataRecord)
+		}
+		if m.Images == nil {
+			m.Images = make(map[string]string)
+		}
+		if m.ImagesFetched == nil {
+			m.ImagesFetched = make(map[string]time.Time)
+		}
+		return m
+	case err == nil:
+		logInfo("cache format version %d is not %d; card metadata will be refetched", m.FormatVersion, cacheFormatVersion)
+	case os.IsNotExist(err):
+		logDebug("no cache manifest; creating one")
+	default:
+		logWarn("unreadable cache manifest (%v); rebuilding it", err)
+	}
+
+	m.FormatVersion = cacheFormatVersion
+	m.Metadata = make(map[string]metadataRecord)
+	m.Images = make(map[string]string)
+	m.ImagesFetched = make(map[string]time.Time)
+	for _, name := range cachedImages(cache) {
+		data, err := ioutil.ReadFile(filepath.Join(cache.Path, cacheImageFolder, name))
+		if err == nil {
+			m.Images[name] = checksum(data)
+		}
+	}
+	err = m.saveLocked()
+	if err != nil {
+		logWarn("failed saving cache manifest: %v", err)
+	}
+	return m
+}
+
+// cachedImages lists the paths of the images in the cache's image folder.
+func cachedImages(cache *configdir.Config) []string {
+	var names []string
+	root := filepath.Join(cache.Path, cacheImageFolder)
+	_ = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || filepath.Ext(p) == ".tmp" {
+			return nil
+		}
+		name, err := filepath.Rel(root, p)
+		if err == nil {
+			names = append(names, filepath.ToSlash(name))
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// metadata returns the record of a metadata file, if it was fetched by this
+// cache format version.
+func (m *cacheManifest) metadata(dbName string) (metadataRecord, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rec, ok := m.Metadata[dbName]
+	return rec, ok
+}
+
+// storeMetadata writes a metadata file just fetched to the cache and notes
+// when it was fetched.
+func (m *cacheManifest) storeMetadata(dbName string, data []byte, etag string) error {
+	return m.update(func() error {
+		err := writeCacheFile(m.cache, dbName, data)
+		if err != nil {
+			return err
+		}
+		m.Metadata[dbName] = metadataRecord{FetchedAt: time.Now().UTC(), ETag: etag}
+		return nil
+	})
+}
+
+// storeImage writes an image just fetched to the cache and records it.  If
+// the cache already holds the same image, as when another run has just
+// stored it or an expired image is unchanged, only its fetch time is
+// updated.
+func (m *cacheManifest) storeImage(name string, data []byte) error {
+	return m.update(func() error {
+		sum := checksum(data)
+		path := filepath.Join(cacheImageFolder, name)
+		if m.Images[filepath.ToSlash(name)] != sum || !m.cache.Exists(path) {
+			err := writeCacheFile(m.cache, path, data)
+			if err != nil {
+				return err
+			}
+		}
+		m.Images[filepath.ToSlash(name)] = sum
+		m.ImagesFetched[filepath.ToSlash(name)] = time.Now().UTC()
+		return nil
+	})
+}
+
+// recordImage notes the checksum of an image already in the cache, and that
+// it was just fetched.
+func (m *cacheManifest) recordImage(name string, data []byte) error {
+	return m.update(func() error {
+		m.Images[filepath.ToSlash(name)] = checksum(data)
+		m.ImagesFetched[filepath.ToSlash(name)] = time.Now().UTC()
+		return nil
+	})
+}
+
+// forgetImage drops an image's checksum and fetch time.
+func (m *cacheManifest) forgetImage(name string) error {
+	return m.update(func() error {
+		delete(m.Images, filepath.ToSlash(name))
+		delete(m.ImagesFetched, filepath.ToSlash(name))
+		return nil
+	})
+}
+
+// update makes a change to the manifest and saves it.  Unless the cache is
+// read-only, it holds the cache lock and starts from the manifest as last
+// saved by any run.
+func (m *cacheManifest) update(change func() error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.readOnly {
+		return change()
+	}
+
+	unlock, err := lockCache(m.cache)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m.reloadLocked()
+	err = change()
+	if err != nil {
+		return err
+	}
+	return m.saveLocked()
+}
+
+// reloadLocked replaces the records with those of the saved manifest, if it
+// is of this format version.  The caller holds m.mu and the cache lock.
+func (m *cacheManifest) reloadLocked() {
+	data, err := m.cache.ReadFile(manifestName)
+	if err != nil {
+		return
+	}
+	var saved struct {
+		FormatVersion int                       `json:"format_version"`
+		Metadata      map[string]metadataRecord `json:"metadata"`
+		Images        map[string]string         `json:"images"`
+		ImagesFetched map[string]time.Time      `json:"images_fetched"`
+	}
+	if json.Unmarshal(data, &saved) != nil || saved.FormatVersion != cacheFormatVersion {
+		return
+	}
+	m.Metadata, m.Images, m.ImagesFetched = saved.Metadata, saved.Images, saved.ImagesFetched
+	if m.Metadata == nil {
+		m.Metadata = make(map[string]metadataRecord)
+	}
+	if m.Images == nil {
+		m.Images = make(map[string]string)
+	}
+	if m.ImagesFetched == nil {
+		m.ImagesFetched = make(map[string]time.Time)
+	}
+}
+
+// imageFetched returns when an image was fetched, if known.
+func (m *cacheManifest) imageFetched(name string) (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.ImagesFetched[filepath.ToSlash(name)]
+	return t, ok
+}
+
+// checkImage reports whether an image is in the cache and matches its
+// checksum, if it has one.  An empty file, as left by an interrupted write,
+// is never ok.
+func (m *cacheManifest) checkImage(name string) (exists bool, ok bool) {
+	data, err := ioutil.ReadFile(filepath.Join(m.cache.Path, cacheImageFolder, name))
+	if err != nil {
+		return false, false
+	}
+	if len(data) == 0 {
+		return true, false
+	}
+	m.mu.Lock()
+	want, known := m.Images[filepath.ToSlash(name)]
+	m.mu.Unlock()
+	return true, !known || checksum(data) == want
+}
+
+// saveLocked writes the manifest atomically, unless the cache is read-only.
+// The caller holds m.mu, so saves land in the order of their changes.
+func (m *cacheManifest) saveLocked() error {
+	if m.readOnly {
+		return nil
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeCacheFile(m.cache, manifestName, data)
+}
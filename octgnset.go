@@ -0,0 +1,100 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strconv"
+	"strings"
+)
+
+// Sections of a deck read from an OCTGN set.xml file.  Cards belonging to
+// an encounter set go in encounterSectionName, so --skip-sections can leave
+// out either kind.
+const (
+	playerSectionName    = "Player"
+	encounterSectionName = "Encounter"
+)
+
+// xmlSet is the card list of an OCTGN set definition file, as shipped with
+// the LOTR LCG plugin for each pack.
+type xmlSet struct {
+	XMLName xml.Name     `xml:"set"`
+	Name    string       `xml:"name,attr"`
+	Cards   []xmlSetCard `xml:"cards>card"`
+}
+
+type xmlSetCard struct {
+	ID         string           `xml:"id,attr"`
+	Name       string           `xml:"name,attr"`
+	Properties []xmlSetProperty `xml:"property"`
+}
+
+type xmlSetProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+func (c xmlSetCard) property(name string) string {
+	for _, p := range c.Properties {
+		if strings.EqualFold(p.Name, name) {
+			return strings.TrimSpace(p.Value)
+		}
+	}
+	return ""
+}
+
+// isOCTGNSet reports whether data is an XML document whose root element is
+// <set>, rather than a <deck>.
+func isOCTGNSet(data []byte) bool {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return false
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start.Name.Local == "set"
+		}
+	}
+}
+
+// parseSetFile reads an OCTGN set.xml file as a deck holding every card of
+// the pack.  The number of copies comes from each card's Quantity property,
+// defaulting to 1.
+func parseSetFile(data []byte) (XMLDeck, error) {
+	var set xmlSet
+	err := xml.Unmarshal(data, &set)
+	if err != nil {
+		return XMLDeck{}, err
+	}
+
+	player := XMLSection{Name: playerSectionName}
+	encounter := XMLSection{Name: encounterSectionName}
+	for _, c := range set.Cards {
+		qty, err := strconv.Atoi(c.property("Quantity"))
+		if err != nil || qty < 1 {
+			qty = 1
+		}
+		card := XMLCard{Card: c.Name, Quantity: qty, OctgnID: c.ID}
+		if c.property("Encounter Set") != "" {
+			encounter.Cards = append(encounter.Cards, card)
+		} else {
+			player.Cards = append(player.Cards, card)
+		}
+	}
+	logInfo("read %d cards of set %q", len(set.Cards), set.Name)
+
+	var deck XMLDeck
+	for _, s := range []XMLSection{player, encounter} {
+		if len(s.Cards) > 0 {
+			deck.Sections = append(deck.Sections, s)
+		}
+	}
+	return deck, nil
+}
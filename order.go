@@ -0,0 +1,153 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fields cards can be sorted by with --card-render-order.
+var sortFields = []string{"section", "name", "quantity", "cost", "sphere", "type"}
+
+// sortKeys is a flag holding a comma-separated list of sort fields.
+type sortKeys struct {
+	keys *[]string
+}
+
+func (sk sortKeys) String() string {
+	if sk.keys == nil {
+		return ""
+	}
+	return strings.Join(*sk.keys, ",")
+}
+
+func (sk sortKeys) Set(s string) error {
+	var keys []string
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		if !isSortField(k) {
+			return fmt.Errorf("unknown sort field %q", k)
+		}
+		keys = append(keys, k)
+	}
+	*sk.keys = keys
+	return nil
+}
+
+func isSortField(k string) bool {
+	for _, f := range sortFields {
+		if f == k {
+			return true
+		}
+	}
+	return false
+}
+
+// sortDeck stably sorts cards by the given fields in priority order.  Unless
+// "section" is one of the fields, sections keep their order in the deck and
+// cards are only sorted within each section.
+func sortDeck(deck []XMLCard, keys []string) {
+	sectionOrder := make(map[string]int)
+	for _, card := range deck {
+		if _, ok := sectionOrder[card.Section]; !ok {
+			sectionOrder[card.Section] = len(sectionOrder)
+		}
+	}
+
+	sort.SliceStable(deck, func(i, j int) bool {
+		a, b := deck[i], deck[j]
+		if !isSortKey(keys, "section") && a.Section != b.Section {
+			return sectionOrder[a.Section] < sectionOrder[b.Section]
+		}
+		for _, k := range keys {
+			if c := compareCards(a, b, k); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
+
+// Fields the whole deck can be sorted by with --sort; sortNone keeps the
+// deck's order.
+const sortNone = "none"
+
+var wholeDeckSortFields = []string{sortNone, "name", "type", "sphere"}
+
+func isWholeDeckSortField(k string) bool {
+	for _, f := range wholeDeckSortFields {
+		if f == k {
+			return true
+		}
+	}
+	return false
+}
+
+// sortWholeDeck stably sorts cards by a field across all sections, so the
+// order doesn't depend on how the deck file arranges them.  Copies of a card
+// are expanded later and so stay together.
+func sortWholeDeck(deck []XMLCard, field string) {
+	sort.SliceStable(deck, func(i, j int) bool {
+		return compareCards(deck[i], deck[j], field) < 0
+	})
+}
+
+func isSortKey(keys []string, k string) bool {
+	for _, key := range keys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+// compareCards compares a field of two cards, returning a negative number,
+// zero or a positive number as a sorts before, with or after b.
+func compareCards(a, b XMLCard, field string) int {
+	switch field {
+	case "section":
+		return strings.Compare(a.Section, b.Section)
+	case "name":
+		return strings.Compare(a.Name, b.Name)
+	case "quantity":
+		return a.Quantity - b.Quantity
+	case "cost":
+		return compareCosts(a.Cost, b.Cost)
+	case "sphere":
+		return strings.Compare(a.Sphere, b.Sphere)
+	case "type":
+		return strings.Compare(a.Type, b.Type)
+	}
+	return 0
+}
+
+// compareCosts orders numeric costs numerically, before others such as "X",
+// which are ordered as strings.
+func compareCosts(a, b string) int {
+	x, errA := strconv.ParseFloat(a, 64)
+	y, errB := strconv.ParseFloat(b, 64)
+	switch {
+	case errA == nil && errB == nil:
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
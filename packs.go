@@ -0,0 +1,102 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// readPackList parses the --packs-owned value: comma-separated pack codes,
+// or the name of a file of pack codes separated by commas or whitespace, in
+// which '#' starts a comment.  Codes are lowercased.
+func readPackList(s string) (map[string]bool, error) {
+	text := s
+	if fi, err := os.Stat(s); err == nil && !fi.IsDir() {
+		data, err := ioutil.ReadFile(s)
+		if err != nil {
+			return nil, err
+		}
+		var lines []string
+		for _, line := range strings.Split(string(data), "\n") {
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			lines = append(lines, line)
+		}
+		text = strings.Join(lines, ",")
+	}
+
+	codes := make(map[string]bool)
+	for _, f := range strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r'
+	}) {
+		codes[strings.ToLower(f)] = true
+	}
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("no pack codes in --packs-owned %q", s)
+	}
+	return codes, nil
+}
+
+// leaveOutOwnedPacks drops the cards from packs in --packs-owned.  Cards
+// whose pack isn't known are kept, since they might not be owned.
+func (app *App) leaveOutOwnedPacks(deck []XMLCard) []XMLCard {
+	known := make(map[string]bool)
+	for _, info := range app.octgnToCard {
+		if info.Pack != "" {
+			known[strings.ToLower(info.Pack)] = true
+		}
+	}
+	for code := range app.packsOwned {
+		if !known[code] {
+			logWarn("--packs-owned: unknown pack code %q", code)
+		}
+	}
+
+	kept := make([]XMLCard, 0, len(deck))
+	left := 0
+	for _, card := range deck {
+		switch {
+		case card.Pack == "":
+			logWarn("pack of %s is unknown; printing it", card.Name)
+		case app.packsOwned[strings.ToLower(card.Pack)]:
+			logDebug("leaving out %s from owned pack %s", card.Name, card.Pack)
+			left += card.Quantity
+			continue
+		}
+		kept = append(kept, card)
+	}
+	countLog(left).info("left out %d copies from owned packs", left)
+	return kept
+}
+
+// ListPacks prints the code and name of each pack in the card metadata, in
+// order of code, for --list-packs.
+func (app *App) ListPacks() {
+	if app.err != nil {
+		return
+	}
+
+	names := make(map[string]string)
+	for _, info := range app.octgnToCard {
+		if info.Pack != "" {
+			names[info.Pack] = info.PackName
+		}
+	}
+	codes := make([]string, 0, len(names))
+	for code := range names {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Printf("%s\t%s\n", code, names[code])
+	}
+}
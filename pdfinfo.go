@@ -0,0 +1,245 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"unicode/utf16"
+)
+
+var pdfInfoRef = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+
+// dumpPDFInfo prints the document information dictionary of a written PDF
+// to stdout as a JSON object.  If zipped, the PDF is read from inside the
+// ZIP archive at path.
+func dumpPDFInfo(path string, zipped bool) error {
+	data, err := readOutputPDF(path, zipped)
+	if err != nil {
+		return err
+	}
+	info, err := readPDFInfo(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	out, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(out))
+	return err
+}
+
+func readOutputPDF(path string, zipped bool) ([]byte, error) {
+	if !zipped {
+		return ioutil.ReadFile(path)
+	}
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	if len(zr.File) == 0 {
+		return nil, fmt.Errorf("%s: empty archive", path)
+	}
+	f, err := zr.File[0].Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// readPDFInfo finds the document information dictionary through the last
+// trailer of an uncompressed PDF and returns its entries.  Only the subset of
+// PDF syntax that appears in such dictionaries is understood.
+func readPDFInfo(data []byte) (map[string]string, error) {
+	trailer := bytes.LastIndex(data, []byte("trailer"))
+	if trailer < 0 {
+		return nil, errors.New("no PDF trailer")
+	}
+	ref := pdfInfoRef.FindSubmatch(data[trailer:])
+	if ref == nil {
+		return nil, errors.New("no document information dictionary")
+	}
+
+	obj := regexp.MustCompile(`(?m)^` + string(ref[1]) + `\s+` + string(ref[2]) + `\s+obj\s*<<`)
+	loc := obj.FindIndex(data)
+	if loc == nil {
+		return nil, fmt.Errorf("document information object %s %s not found", ref[1], ref[2])
+	}
+
+	p := &pdfDictParser{data: data, pos: loc[1]}
+	return p.parse()
+}
+
+// pdfDictParser reads the entries of a dictionary whose values are strings,
+// names, numbers or other simple tokens.
+type pdfDictParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *pdfDictParser) parse() (map[string]string, error) {
+	entries := make(map[string]string)
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return nil, errors.New("unterminated dictionary")
+		}
+		if bytes.HasPrefix(p.data[p.pos:], []byte(">>")) {
+			return entries, nil
+		}
+		if p.data[p.pos] != '/' {
+			return nil, fmt.Errorf("expected a name at offset %d", p.pos)
+		}
+		key := p.token()[1:]
+		p.skipSpace()
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		entries[key] = value
+	}
+}
+
+func (p *pdfDictParser) skipSpace() {
+	for p.pos < len(p.data) && isPDFSpace(p.data[p.pos]) {
+		p.pos++
+	}
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return bytes.IndexByte([]byte("()<>[]{}/%"), c) >= 0
+}
+
+// token reads a name or other bare token.
+func (p *pdfDictParser) token() string {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.data) && !isPDFSpace(p.data[p.pos]) && !isPDFDelimiter(p.data[p.pos]) {
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+func (p *pdfDictParser) value() (string, error) {
+	if p.pos >= len(p.data) {
+		return "", errors.New("missing value")
+	}
+	switch {
+	case p.data[p.pos] == '(':
+		return p.literalString()
+	case bytes.HasPrefix(p.data[p.pos:], []byte("<<")):
+		return "", fmt.Errorf("nested dictionary at offset %d not supported", p.pos)
+	case p.data[p.pos] == '<':
+		return p.hexString()
+	case p.data[p.pos] == '/':
+		return p.token()[1:], nil
+	}
+	return p.token(), nil
+}
+
+func (p *pdfDictParser) literalString() (string, error) {
+	var buf []byte
+	depth := 0
+	for p.pos++; p.pos < len(p.data); p.pos++ {
+		c := p.data[p.pos]
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				p.pos++
+				return decodePDFText(buf), nil
+			}
+			depth--
+		case '\\':
+			p.pos++
+			if p.pos >= len(p.data) {
+				break
+			}
+			c = p.data[p.pos]
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					end := p.pos + 1
+					for end < len(p.data) && end < p.pos+3 && p.data[end] >= '0' && p.data[end] <= '7' {
+						end++
+					}
+					v, _ := strconv.ParseUint(string(p.data[p.pos:end]), 8, 8)
+					c = byte(v)
+					p.pos = end - 1
+				}
+			}
+		}
+		buf = append(buf, c)
+	}
+	return "", errors.New("unterminated string")
+}
+
+func (p *pdfDictParser) hexString() (string, error) {
+	end := bytes.IndexByte(p.data[p.pos:], '>')
+	if end < 0 {
+		return "", errors.New("unterminated hex string")
+	}
+	digits := bytes.Map(func(r rune) rune {
+		if isPDFSpace(byte(r)) {
+			return -1
+		}
+		return r
+	}, p.data[p.pos+1:p.pos+end])
+	p.pos += end + 1
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	buf := make([]byte, len(digits)/2)
+	for i := range buf {
+		v, err := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("bad hex string: %v", err)
+		}
+		buf[i] = byte(v)
+	}
+	return decodePDFText(buf), nil
+}
+
+// decodePDFText converts a PDF text string, which is UTF-16BE if it starts
+// with a byte order mark, to UTF-8.
+func decodePDFText(b []byte) string {
+	if len(b) < 2 || b[0] != 0xfe || b[1] != 0xff {
+		return string(b)
+	}
+	units := make([]uint16, 0, len(b)/2)
+	for i := 2; i+1 < len(b); i += 2 {
+		units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
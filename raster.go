@@ -0,0 +1,175 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shibukawa/configdir"
+)
+
+const defaultPNGDPI = 300
+
+func (app *App) CreatePNG() {
+	if app.err != nil || app.format != "png" {
+		return
+	}
+	defer app.failed(stageOutput)
+
+	if len(app.deck) == 0 {
+		logInfo("no cards in the deck; will not create PNG")
+		return
+	}
+
+	if app.labels || app.footer || app.render.Shadow || app.render.Stamp != "" || app.render.Back != nil || app.render.Filler != nil ||
+		app.render.BorderWidth > 0 || app.render.CutLines ||
+		app.render.CornerRadius > 0 || app.layout.Border > 0 || app.render.Watermark.Text != "" || app.summary {
+		logWarn("PNG output contains card images only; labels, footer, card backs, summary and decorations are omitted")
+	}
+
+	sheets := &pngSheets{
+		cache:    app.cache,
+		readOnly: app.cacheReadOnly,
+		proc:     app.imageProc,
+		fit:      app.render.ImageFit,
+		layout:   app.layout,
+		dpi:      app.pngDPI,
+		images:   make(map[string]image.Image),
+	}
+	for _, group := range app.outputGroups() {
+		app.err = sheets.render(app.expandDeck(group.deck), group.path)
+		if app.err != nil {
+			break
+		}
+	}
+	app.missing = append(app.missing, sheets.skipped...)
+}
+
+// pngSheets composites pages of cards into raster images using the same
+// slot geometry as the PDF renderer.
+type pngSheets struct {
+	cache    *configdir.Config
+	readOnly bool
+	proc     ImageProcessing
+	fit      string
+	layout   Layout
+	dpi      int
+
+	// images holds each card image scaled to the slot size, or nil if the
+	// image is unusable.
+	images  map[string]image.Image
+	skipped []string
+}
+
+// render writes one PNG per page, named after outputPath with a three digit
+// page number, e.g. output-001.png.
+func (ps *pngSheets) render(cards []XMLCard, outputPath string) error {
+	base := strings.TrimSuffix(outputPath, filepath.Ext(outputPath))
+	pages, err := paginate(cards, ps.layout.CardsPerPage(), ps.loadImages)
+	if err != nil {
+		return err
+	}
+	for i, page := range pages {
+		fileName := fmt.Sprintf("%s-%03d.png", base, i+1)
+		err = ps.writeSheet(page, fileName)
+		if err != nil {
+			return fmt.Errorf("could not write %s: %v", fileName, err)
+		}
+		imageLog(fileName).info("wrote %s", fileName)
+	}
+	return nil
+}
+
+// loadImages decodes and scales any not-yet-seen images for the given cards
+// and returns the cards whose images are usable.
+func (ps *pngSheets) loadImages(cards []XMLCard) ([]XMLCard, error) {
+	usable := make([]XMLCard, 0, len(cards))
+	for _, card := range cards {
+		img, seen := ps.images[card.ImagePath]
+		if !seen {
+			var err error
+			img, err = ps.loadImage(card)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", card.ImagePath, err)
+			}
+			ps.images[card.ImagePath] = img
+		}
+		if img == nil {
+			ps.skipped = append(ps.skipped, card.OctgnID)
+			continue
+		}
+		usable = append(usable, card)
+	}
+	return usable, nil
+}
+
+func (ps *pngSheets) loadImage(card XMLCard) (image.Image, error) {
+	p := prepareImage(ps.cache, ps.readOnly, ps.proc, card, ioutil.ReadFile)
+	if p.err != nil || !p.valid {
+		return nil, p.err
+	}
+	img, _, err := image.Decode(bytes.NewReader(p.data))
+	if err != nil {
+		imageLog(card.ImagePath).info("could not decode image for %s (%s): %v (skipping it)", card.ImagePath, card.Card, err)
+		return nil, nil
+	}
+	w, h := ps.px(ps.layout.CardWidth), ps.px(ps.layout.CardHeight)
+	if ps.fit == fitFill {
+		return resample(img, w, h), nil
+	}
+
+	// Scale to the fitted size and center on a transparent card, which
+	// crops anything outside it.
+	slot := Rect{W: float64(w), H: float64(h)}
+	b := img.Bounds()
+	r := slot.Fit(float64(b.Dx()), float64(b.Dy()), ps.fit)
+	scaled := resample(img, int(math.Round(r.W)), int(math.Round(r.H)))
+	fitted := image.NewRGBA(image.Rect(0, 0, w, h))
+	at := image.Pt(int(math.Round(r.X)), int(math.Round(r.Y)))
+	draw.Draw(fitted, scaled.Bounds().Add(at), scaled, image.Point{}, draw.Src)
+	return fitted, nil
+}
+
+func (ps *pngSheets) writeSheet(cards []XMLCard, fileName string) error {
+	sheet := image.NewRGBA(image.Rect(0, 0, ps.px(ps.layout.PageWidth), ps.px(ps.layout.PageHeight)))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	for i, slot := range ps.layout.Slots() {
+		if i >= len(cards) {
+			break
+		}
+		img := ps.images[cards[i].ImagePath]
+		at := image.Pt(ps.px(slot.X), ps.px(slot.Y))
+		draw.Draw(sheet, img.Bounds().Add(at), img, image.Point{}, draw.Over)
+	}
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, sheet)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// px converts millimeters to pixels at the sheet resolution.
+func (ps *pngSheets) px(mm float64) int {
+	return int(math.Round(mm / mmPerInch * float64(ps.dpi)))
+}
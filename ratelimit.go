@@ -0,0 +1,88 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default for --rate-limit, in requests per second.
+const defaultRateLimit = 4.0
+
+// Most times a request answered with 429 Too Many Requests is retried.
+const maxRetries = 3
+
+// Wait before retrying a 429 response without a usable Retry-After header.
+const defaultRetryAfter = 2 * time.Second
+
+// rateLimiter is a token bucket holding up to a second's worth of requests.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for rate requests per second, or nil if
+// rate is zero.
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate == 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, tokens: math.Max(rate, 1), last: time.Now()}
+}
+
+// wait blocks until a request may be sent or ctx is done.
+func (rl *rateLimiter) wait(ctx context.Context) error {
+	if rl == nil {
+		return nil
+	}
+
+	// Taking a token that isn't there yet reserves the next one to arrive.
+	rl.mu.Lock()
+	now := time.Now()
+	rl.tokens = math.Min(math.Max(rl.rate, 1), rl.tokens+now.Sub(rl.last).Seconds()*rl.rate)
+	rl.last = now
+	rl.tokens--
+	delay := time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	rl.mu.Unlock()
+
+	return sleepContext(ctx, delay)
+}
+
+// sleepContext waits for d or until ctx is done, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryAfter returns how long a 429 response asks clients to wait.  The
+// Retry-After header may be a number of seconds or an HTTP date.
+func retryAfter(resp *http.Response) time.Duration {
+	h := resp.Header.Get("Retry-After")
+	if secs, err := strconv.Atoi(h); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return time.Until(t)
+	}
+	return defaultRetryAfter
+}
@@ -0,0 +1,253 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+var (
+	pdfObjHeader = regexp.MustCompile(`^(\d+) 0 obj\n`)
+	pdfObjRef    = regexp.MustCompile(`\b(\d+) 0 R\b`)
+	pdfSMaskRef  = regexp.MustCompile(`/SMask (\d+) 0 R`)
+	pdfPageBoxes = regexp.MustCompile(`(?m)(?:^/[A-Za-z]+Box \[[^\]\n]*\]\n)+`)
+)
+
+// writeCanonicalPDF writes pdf to w for --reproducible.  gofpdf writes its
+// images in map order, sorting them only by width with SetCatalogSort, so
+// the image objects are renumbered in order of their content.  It writes
+// the page boxes of --page-bleed-box in map order too, so they are sorted.
+func writeCanonicalPDF(pdf *gofpdf.Fpdf, w io.Writer) error {
+	var buf bytes.Buffer
+	err := pdf.Output(&buf)
+	if err != nil {
+		return err
+	}
+	data, err := sortPageBoxes(buf.Bytes())
+	if err == nil {
+		data, err = canonicalImageOrder(data)
+	}
+	if err != nil {
+		return fmt.Errorf("could not reorder PDF images: %v", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// pdfObject is one indirect object of a PDF as written by gofpdf.
+type pdfObject struct {
+	num    int
+	offset int
+	data   []byte // from "n 0 obj" through "endobj"
+}
+
+// dict returns the part of the object before its stream, if any.
+func (o pdfObject) dict() []byte {
+	if i := bytes.Index(o.data, []byte(">>\nstream\n")); i >= 0 {
+		return o.data[:i]
+	}
+	return o.data
+}
+
+// stream returns the object's stream, or nil if it has none.
+func (o pdfObject) stream() []byte {
+	if i := bytes.Index(o.data, []byte(">>\nstream\n")); i >= 0 {
+		return o.data[i:]
+	}
+	return nil
+}
+
+func (o pdfObject) isImage() bool {
+	return bytes.Contains(o.dict(), []byte("/Subtype /Image"))
+}
+
+// canonicalImageOrder rewrites a PDF written by gofpdf with its image
+// objects, each followed by its soft mask if any, numbered and placed in
+// order of their image data.  References to renumbered objects are updated
+// outside of streams, and the cross-reference table is rebuilt.
+func canonicalImageOrder(data []byte) ([]byte, error) {
+	objects, trailer, err := splitPDFObjects(data)
+	if err != nil {
+		return nil, err
+	}
+
+	isMask := make(map[int]bool)
+	var slots []int
+	for _, o := range objects {
+		if !o.isImage() {
+			continue
+		}
+		slots = append(slots, o.num)
+		if m := pdfSMaskRef.FindSubmatch(o.dict()); m != nil {
+			n, _ := strconv.Atoi(string(m[1]))
+			isMask[n] = true
+		}
+	}
+	var images []pdfObject
+	masks := make(map[int]pdfObject)
+	for _, o := range objects {
+		if isMask[o.num] {
+			masks[o.num] = o
+		} else if o.isImage() {
+			images = append(images, o)
+		}
+	}
+
+	maskOf := func(o pdfObject) (pdfObject, bool) {
+		m := pdfSMaskRef.FindSubmatch(o.dict())
+		if m == nil {
+			return pdfObject{}, false
+		}
+		n, _ := strconv.Atoi(string(m[1]))
+		return masks[n], true
+	}
+	sortKey := func(o pdfObject) []byte {
+		key := o.stream()
+		if m, ok := maskOf(o); ok {
+			key = append(append([]byte{}, key...), m.stream()...)
+		}
+		return key
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return bytes.Compare(sortKey(images[i]), sortKey(images[j])) < 0
+	})
+
+	// Hand out the image objects' numbers again in the new order.
+	sort.Ints(slots)
+	renumber := make(map[int]int)
+	var ordered []pdfObject
+	for _, o := range images {
+		ordered = append(ordered, o)
+		if m, ok := maskOf(o); ok {
+			ordered = append(ordered, m)
+		}
+	}
+	if len(ordered) != len(slots) {
+		return nil, errors.New("image soft masks don't match images")
+	}
+	for i, o := range ordered {
+		renumber[o.num] = slots[i]
+	}
+
+	var out bytes.Buffer
+	offsets := make(map[int]int)
+	write := func(o pdfObject) {
+		num := o.num
+		if n, ok := renumber[num]; ok {
+			num = n
+		}
+		offsets[num] = out.Len()
+		body := pdfObjHeader.ReplaceAll(o.data, []byte(strconv.Itoa(num)+" 0 obj\n"))
+		dict := body[:len(body)-len(o.stream())]
+		out.Write(pdfObjRef.ReplaceAllFunc(dict, func(ref []byte) []byte {
+			n, _ := strconv.Atoi(string(pdfObjRef.FindSubmatch(ref)[1]))
+			if to, ok := renumber[n]; ok {
+				return []byte(strconv.Itoa(to) + " 0 R")
+			}
+			return ref
+		}))
+		out.Write(o.stream())
+	}
+
+	out.Write(data[:objects[0].offset])
+	imagesWritten := false
+	for _, o := range objects {
+		if _, ok := renumber[o.num]; !ok {
+			write(o)
+			continue
+		}
+		if !imagesWritten {
+			for _, img := range ordered {
+				write(img)
+			}
+			imagesWritten = true
+		}
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for n := 1; n <= len(objects); n++ {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offsets[n])
+	}
+	out.Write(trailer)
+	fmt.Fprintf(&out, "startxref\n%d\n%%%%EOF\n", xref)
+	return out.Bytes(), nil
+}
+
+// sortPageBoxes sorts the page box entries, such as /TrimBox, of each page
+// object by name.  Each entry is on its own line, so sorting the lines
+// leaves every object the same length and the cross-reference table valid.
+func sortPageBoxes(data []byte) ([]byte, error) {
+	objects, _, err := splitPDFObjects(data)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, data...)
+	for _, o := range objects {
+		dict := o.dict()
+		if !bytes.Contains(dict, []byte("/Type /Page\n")) {
+			continue
+		}
+		for _, loc := range pdfPageBoxes.FindAllIndex(dict, -1) {
+			lines := bytes.SplitAfter(dict[loc[0]:loc[1]], []byte("\n"))
+			sort.Slice(lines, func(i, j int) bool { return bytes.Compare(lines[i], lines[j]) < 0 })
+			copy(out[o.offset+loc[0]:], bytes.Join(lines, nil))
+		}
+	}
+	return out, nil
+}
+
+// splitPDFObjects returns the objects of a PDF with a single cross-reference
+// table, in file order, and its trailer dictionary up to "startxref".
+func splitPDFObjects(data []byte) ([]pdfObject, []byte, error) {
+	xref := bytes.LastIndex(data, []byte("\nxref\n"))
+	trailer := bytes.LastIndex(data, []byte("\ntrailer\n"))
+	startxref := bytes.LastIndex(data, []byte("\nstartxref\n"))
+	if xref < 0 || trailer < xref || startxref < trailer {
+		return nil, nil, errors.New("no cross-reference table")
+	}
+
+	lines := bytes.Split(data[xref+len("\nxref\n"):trailer], []byte("\n"))
+	var objects []pdfObject
+	for n, line := range lines[2:] { // after the subsection header and object 0
+		var off int
+		_, err := fmt.Sscanf(string(line), "%d", &off)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad cross-reference entry %q", line)
+		}
+		objects = append(objects, pdfObject{num: n + 1, offset: off})
+	}
+	if len(objects) == 0 {
+		return nil, nil, errors.New("no objects")
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].offset < objects[j].offset })
+	for i := range objects {
+		end := xref + 1
+		if i+1 < len(objects) {
+			end = objects[i+1].offset
+		}
+		o := &objects[i]
+		if o.offset < 0 || o.offset >= end {
+			return nil, nil, fmt.Errorf("bad offset for object %d", o.num)
+		}
+		o.data = data[o.offset:end]
+		m := pdfObjHeader.FindSubmatch(o.data)
+		if m == nil || string(m[1]) != strconv.Itoa(o.num) {
+			return nil, nil, fmt.Errorf("object %d not at its offset", o.num)
+		}
+	}
+	return objects, data[trailer+1 : startxref+1], nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// testImage returns a w x h image of one color, encoded as "png" or "jpeg".
+// A color that isn't opaque gives a PNG with an alpha channel.
+func testImage(t testing.TB, format string, w, h int, c color.Color) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testCards caches an image for each of n cards, all of the same size,
+// alternating between alpha PNGs and JPEGs, and returns the cards.
+func testCards(t testing.TB, manifest *cacheManifest, n int) []XMLCard {
+	var cards []XMLCard
+	for i := 0; i < n; i++ {
+		c := color.NRGBA{R: uint8(i * 37), G: uint8(255 - i*11), B: uint8(i * 5), A: 255}
+		name := fmt.Sprintf("Core/%03d.jpg", i+1)
+		format := "jpeg"
+		if i%2 == 0 {
+			c.A = 128
+			name = fmt.Sprintf("Core/%03d.png", i+1)
+			format = "png"
+		}
+		err := manifest.storeImage(name, testImage(t, format, 50, 70, c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cards = append(cards, XMLCard{Card: name, Quantity: 1, Name: name, ImagePath: name, Section: "Hero"})
+	}
+	return cards
+}
+
+func TestReproduciblePDF(t *testing.T) {
+	app, cleanup := newTestApp(t, "")
+	defer cleanup()
+	app.deck = testCards(t, app.manifest, 12)
+	app.format = "pdf"
+	app.layout = pageSizePresets["us-letter"]
+	app.render.ImageFit = fitContain
+	app.copies = 1
+	app.reproducible = true
+	app.buildTime = time.Unix(0, 0).UTC()
+
+	// gofpdf writes images, and the page boxes of a bleed, in map order,
+	// so a few runs are compared to catch an order that changes.
+	for _, bleed := range []float64{0, 3} {
+		app.render.Bleed = bleed
+		var first []byte
+		for i := 0; i < 5; i++ {
+			app.outputFile = filepath.Join(app.cache.Path, "deck"+strconv.Itoa(i)+".pdf")
+			app.CreatePDF()
+			if app.err != nil {
+				t.Fatalf("bleed %v: CreatePDF: %v", bleed, app.err)
+			}
+			data, err := ioutil.ReadFile(app.outputFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bleed > 0 && !bytes.Contains(data, []byte("/BleedBox [")) {
+				t.Fatalf("bleed %v: no bleed box in the PDF", bleed)
+			}
+			if first == nil {
+				first = data
+			} else if !bytes.Equal(first, data) {
+				t.Errorf("bleed %v: the same deck gave different PDFs", bleed)
+				break
+			}
+		}
+	}
+}
+
+// testPDF returns a one-page PDF drawing the given images in order, having
+// registered them in the order given by register.
+func testPDF(t *testing.T, images map[string][]byte, draw []string, register []string) []byte {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetCreationDate(time.Unix(0, 0).UTC())
+	pdf.SetCatalogSort(true)
+	for _, name := range register {
+		pdf.RegisterImageOptionsReader(name, gofpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(images[name]))
+	}
+	pdf.AddPage()
+	for i, name := range draw {
+		pdf.ImageOptions(name, float64(10+i*30), 10, 25, 35, false, gofpdf.ImageOptions{}, 0, "")
+	}
+	var buf bytes.Buffer
+	err := pdf.Output(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCanonicalImageOrderSMask(t *testing.T) {
+	images := map[string][]byte{
+		"a": testImage(t, "png", 20, 28, color.NRGBA{R: 200, A: 100}),
+		"b": testImage(t, "png", 20, 28, color.NRGBA{G: 200, A: 255}),
+		"c": testImage(t, "png", 20, 28, color.NRGBA{B: 200, A: 50}),
+		"d": testImage(t, "png", 20, 28, color.NRGBA{R: 90, G: 90, A: 200}),
+		"e": testImage(t, "png", 20, 28, color.NRGBA{R: 10, B: 90, A: 255}),
+	}
+	draw := []string{"a", "b", "c", "d", "e"}
+
+	var outputs [][]byte
+	for _, register := range [][]string{draw, {"e", "d", "c", "b", "a"}, {"c", "a", "e", "b", "d"}} {
+		out, err := canonicalImageOrder(testPDF(t, images, draw, register))
+		if err != nil {
+			t.Fatalf("canonicalImageOrder: %v", err)
+		}
+		outputs = append(outputs, out)
+	}
+	for i := 1; i < len(outputs); i++ {
+		if !bytes.Equal(outputs[0], outputs[i]) {
+			t.Errorf("registration order %d gave a different PDF", i)
+		}
+	}
+
+	// The result must still be a well-formed PDF, with each image's soft
+	// mask written right after it and the images in order of their data.
+	objects, _, err := splitPDFObjects(outputs[0])
+	if err != nil {
+		t.Fatalf("canonical PDF doesn't parse: %v", err)
+	}
+	byNum := make(map[int]pdfObject)
+	for _, o := range objects {
+		byNum[o.num] = o
+	}
+	var prev []byte
+	masks := 0
+	for i, o := range objects {
+		if !o.isImage() || i > 0 && pdfSMaskRef.Match(objects[i-1].dict()) {
+			continue
+		}
+		if prev != nil && bytes.Compare(prev, o.stream()) > 0 {
+			t.Errorf("image %d is out of order", o.num)
+		}
+		prev = o.stream()
+		m := pdfSMaskRef.FindSubmatch(o.dict())
+		if m == nil {
+			continue
+		}
+		masks++
+		n, _ := strconv.Atoi(string(m[1]))
+		if mask, ok := byNum[n]; !ok || !mask.isImage() {
+			t.Errorf("object %d has soft mask %d, which is not an image", o.num, n)
+		} else if i+1 >= len(objects) || objects[i+1].num != n {
+			t.Errorf("soft mask %d doesn't follow image %d", n, o.num)
+		}
+	}
+	if masks != 3 {
+		t.Errorf("found %d images with soft masks, want 3", masks)
+	}
+}
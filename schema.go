@@ -0,0 +1,109 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// Versions of the OCTGN deck file schema, for --deck-schema-version.
+//
+// Version 1 is the format written by RingsDB: <card qty="n" id="..."> in
+// <section> elements.  Version 2 counts copies with a count attribute
+// instead.  Version 3 accepts either attribute and also allows cards directly
+// under <deck>, which go in a section named "Deck".
+const (
+	minDeckSchemaVersion     = 1
+	maxDeckSchemaVersion     = 3
+	defaultDeckSchemaVersion = 1
+)
+
+// Section name for version 3 cards outside any section.
+const unsectionedName = "Deck"
+
+type xmlCardV2 struct {
+	Card    string `xml:",chardata"`
+	Count   int    `xml:"count,attr"`
+	OctgnID string `xml:"id,attr"`
+}
+
+type xmlSectionV2 struct {
+	Name  string      `xml:"name,attr"`
+	Cards []xmlCardV2 `xml:"card"`
+}
+
+type xmlDeckV2 struct {
+	Sections []xmlSectionV2 `xml:"section"`
+}
+
+type xmlCardV3 struct {
+	Card     string `xml:",chardata"`
+	Quantity int    `xml:"qty,attr"`
+	Count    int    `xml:"count,attr"`
+	OctgnID  string `xml:"id,attr"`
+}
+
+type xmlSectionV3 struct {
+	Name  string      `xml:"name,attr"`
+	Cards []xmlCardV3 `xml:"card"`
+}
+
+type xmlDeckV3 struct {
+	Cards    []xmlCardV3    `xml:"card"`
+	Sections []xmlSectionV3 `xml:"section"`
+}
+
+// parseDeck reads a deck file written in the given schema version.
+func parseDeck(data []byte, version int) (XMLDeck, error) {
+	switch version {
+	case 1:
+		var deck XMLDeck
+		err := xml.Unmarshal(data, &deck)
+		return deck, err
+	case 2:
+		var v2 xmlDeckV2
+		err := xml.Unmarshal(data, &v2)
+		if err != nil {
+			return XMLDeck{}, err
+		}
+		var deck XMLDeck
+		for _, s := range v2.Sections {
+			section := XMLSection{Name: s.Name}
+			for _, c := range s.Cards {
+				section.Cards = append(section.Cards, XMLCard{Card: c.Card, Quantity: c.Count, OctgnID: c.OctgnID})
+			}
+			deck.Sections = append(deck.Sections, section)
+		}
+		return deck, nil
+	case 3:
+		var v3 xmlDeckV3
+		err := xml.Unmarshal(data, &v3)
+		if err != nil {
+			return XMLDeck{}, err
+		}
+		sections := v3.Sections
+		if len(v3.Cards) > 0 {
+			sections = append([]xmlSectionV3{{Name: unsectionedName, Cards: v3.Cards}}, sections...)
+		}
+		var deck XMLDeck
+		for _, s := range sections {
+			section := XMLSection{Name: s.Name}
+			for _, c := range s.Cards {
+				qty := c.Quantity
+				if qty == 0 {
+					qty = c.Count
+				}
+				section.Cards = append(section.Cards, XMLCard{Card: c.Card, Quantity: qty, OctgnID: c.OctgnID})
+			}
+			deck.Sections = append(deck.Sections, section)
+		}
+		return deck, nil
+	default:
+		return XMLDeck{}, fmt.Errorf("unknown deck schema version %d", version)
+	}
+}
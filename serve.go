@@ -0,0 +1,318 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits of the serve subcommand.
+const (
+	maxUploadSize        = 1 << 20 // bytes of a request body
+	defaultServeTimeout  = 2 * time.Minute
+	serveShutdownTimeout = 10 * time.Second
+)
+
+// Options a POST /pdf request may set in its query string, each a boolean
+// like the command line option of the same name.  The query may also give
+// a page-size preset.
+var serveBoolOptions = map[string]func(app *App) *bool{
+	"labels":    func(app *App) *bool { return &app.labels },
+	"footer":    func(app *App) *bool { return &app.footer },
+	"cut-lines": func(app *App) *bool { return &app.render.CutLines },
+	"summary":   func(app *App) *bool { return &app.summary },
+}
+
+// server answers the HTTP requests of the serve subcommand.  Each request
+// is handled by its own copy of the App configured by the command line.
+type server struct {
+	app     *App
+	timeout time.Duration
+
+	mu     sync.Mutex // guards app.octgnToCard and loaded
+	loaded time.Time  // when app.octgnToCard was loaded
+}
+
+// Serve answers HTTP requests on the --listen address until the run is
+// interrupted: POST /pdf with a deck returns its PDF, and GET /healthz
+// checks that the cached card metadata can be loaded.  Any card back is
+// fetched once, before listening, and shared by every request, as are the
+// images of the --cache-prewarm-on-start deck.
+func (app *App) Serve() {
+	if app.err != nil {
+		return
+	}
+	timeStage("card back", app.LoadCardBack)
+	if app.err != nil {
+		return
+	}
+
+	s := &server{app: app, timeout: app.timeout, loaded: time.Now()}
+	if s.timeout == 0 {
+		s.timeout = defaultServeTimeout
+	}
+	if app.prewarmDeck != "" {
+		timeStage("prewarm", s.prewarmCache)
+		if app.err != nil {
+			return
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pdf", s.handlePDF)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	srv := &http.Server{Addr: app.listen, Handler: mux, ReadHeaderTimeout: app.httpTimeout}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-app.ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			logWarn("stopping the server: %v", err)
+		}
+	}()
+
+	logInfo("listening on %s", app.listen)
+	err := srv.ListenAndServe()
+	if err != http.ErrServerClosed {
+		app.err = err
+		return
+	}
+	<-stopped
+}
+
+// handlePDF renders the deck in the request body, either the "deck" file
+// of a multipart form or the whole body, as an OCTGN deck or ID list.
+func (s *server) handlePDF(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST a deck to get its PDF", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+	defer cancel()
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxUploadSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxUploadSize {
+		http.Error(w, fmt.Sprintf("the request is larger than %d bytes", maxUploadSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	name, deck, err := deckUpload(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.refreshMetadata(ctx)
+	app := s.newApp(ctx)
+	err = app.applyQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "lotrproxypdf-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	app.inputFile = filepath.Join(dir, name)
+	app.outputFile = filepath.Join(dir, deckName(name)+".pdf")
+	err = ioutil.WriteFile(app.inputFile, deck, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.ParseInputFile()
+	if app.err == nil && len(app.deck) == 0 {
+		http.Error(w, "no cards in the deck have images", http.StatusBadRequest)
+		return
+	}
+	app.PreloadImages()
+	app.CreatePDF()
+	if app.err != nil {
+		logWarn("%s: %v", name, app.err)
+		http.Error(w, app.err.Error(), serveStatus(ctx, app.err))
+		return
+	}
+
+	f, err := os.Open(app.outputFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(app.outputFile)))
+	_, err = io.Copy(w, f)
+	if err != nil {
+		logWarn("%s: sending the PDF: %v", name, err)
+	}
+}
+
+// prewarmCache fetches the images of the --cache-prewarm-on-start deck
+// that aren't cached.  A deck that can't be read stops the server from
+// starting, but images that can't be fetched are only warned about, since
+// a request for the deck tries them again.
+func (s *server) prewarmCache() {
+	app := s.newApp(s.app.ctx)
+	app.inputFile = s.app.prewarmDeck
+	app.ParseInputFile()
+	if app.err != nil {
+		s.app.err = app.err
+		return
+	}
+	failed, err := app.fetchImages(app.deck)
+	if err != nil {
+		s.app.err = &AppError{Stage: stageImages, Err: err}
+		return
+	}
+	if len(failed) > 0 {
+		logWarn("prewarming the cache: %v", imageErrors(failed))
+	}
+	logInfo("prewarmed the cache with the images of %d cards of %s", len(app.deck), app.prewarmDeck)
+}
+
+// handleHealth reports whether the cached card metadata can be loaded.
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	_, _, err := loadFromCache(s.app.cache, s.app.manifest, s.app.cacheDBFile())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot load cached metadata: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// newApp returns an App for one request, with the options and metadata of
+// the server's App.
+func (s *server) newApp(ctx context.Context) *App {
+	s.mu.Lock()
+	app := *s.app
+	s.mu.Unlock()
+	app.ctx = ctx
+	app.err = nil
+	app.deck, app.missing = nil, nil
+	app.nameChoices = make(map[string]string)
+	app.interactive = false
+	return &app
+}
+
+// refreshMetadata loads card metadata again once it is older than
+// metadataMaxAge, keeping what was loaded if that fails.
+func (s *server) refreshMetadata(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.loaded) < metadataMaxAge {
+		return
+	}
+	app := *s.app
+	app.ctx, app.err = ctx, nil
+	app.LoadMetadata()
+	if app.err != nil {
+		logWarn("%v (using the metadata already loaded)", app.err)
+		return
+	}
+	s.app.octgnToCard = app.octgnToCard
+	s.loaded = time.Now()
+}
+
+// applyQuery sets the options given in a request's query string.
+func (app *App) applyQuery(query url.Values) error {
+	for name, values := range query {
+		if name == "page-size" {
+			app.pageSizePreset = values[0]
+			continue
+		}
+		option, ok := serveBoolOptions[name]
+		if !ok {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		v, err := strconv.ParseBool(values[0])
+		if values[0] == "" {
+			v, err = true, nil
+		}
+		if err != nil {
+			return fmt.Errorf("option %s: %v", name, err)
+		}
+		*option(app) = v
+	}
+	var ok bool
+	app.layout, ok = app.pageLayout(app.pageSizePreset)
+	if !ok {
+		return fmt.Errorf("unknown page size preset %q", app.pageSizePreset)
+	}
+	return nil
+}
+
+// deckUpload returns a file name for the uploaded deck and its contents.
+func deckUpload(contentType string, body []byte) (string, []byte, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" {
+		return "deck.o8d", body, nil
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return "", nil, errors.New(`no "deck" file in the form`)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if part.FormName() != "deck" {
+			continue
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return "", nil, err
+		}
+		name := "deck.o8d"
+		if part.FileName() != "" {
+			name = sanitizeFileName(filepath.Base(part.FileName()))
+		}
+		return name, data, nil
+	}
+}
+
+// serveStatus is the HTTP status for a request that failed with err.
+func serveStatus(ctx context.Context, err error) int {
+	if ctx.Err() == context.DeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		switch appErr.Stage {
+		case stageInput:
+			return http.StatusBadRequest
+		case stageMetadata, stageImages:
+			return http.StatusBadGateway
+		}
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestServerPrewarmCache(t *testing.T) {
+	site := newFakeSite(map[string][]byte{
+		"/bundles/cards/01001.png": []byte("Aragorn"),
+		"/bundles/cards/01073.png": []byte("Gandalf"),
+	})
+	defer site.Close()
+	app, cleanup := newTestApp(t, site.URL)
+	defer cleanup()
+	app.inputFormat = inputIDs
+	app.octgnToCard = map[string]CardInfo{
+		"51223bd0-ffd1-11df-a976-0801200c9001": {Name: "Aragorn", Image: "01001.png"},
+		"51223bd0-ffd1-11df-a976-0801200c9004": {Name: "Gimli", Image: "01004.png"},
+		"51223bd0-ffd1-11df-a976-0801200c9073": {Name: "Gandalf", Image: "01073.png"},
+	}
+	app.prewarmDeck = filepath.Join(app.cache.Path, "deck.txt")
+	deck := "51223bd0-ffd1-11df-a976-0801200c9001\n" +
+		"51223bd0-ffd1-11df-a976-0801200c9004\n" +
+		"51223bd0-ffd1-11df-a976-0801200c9073 x3\n"
+	err := ioutil.WriteFile(app.prewarmDeck, []byte(deck), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{app: app}
+
+	// Gimli's image is missing, which doesn't keep the server from
+	// starting.
+	s.prewarmCache()
+	if app.err != nil {
+		t.Fatalf("prewarmCache: %v", app.err)
+	}
+	for _, name := range []string{"01001.png", "01073.png"} {
+		if _, ok := app.manifest.checkImage(name); !ok {
+			t.Errorf("%s was not cached", name)
+		}
+	}
+	if app.deck != nil {
+		t.Error("the prewarmed deck was left in the server's App")
+	}
+
+	app.prewarmDeck = filepath.Join(app.cache.Path, "missing.txt")
+	s.prewarmCache()
+	if app.err == nil {
+		t.Error("a missing deck didn't stop the server from starting")
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Names of the sources card images can be downloaded from.
+const (
+	sourceRingsDB     = "ringsdb"
+	sourceHallOfBeorn = "hallofbeorn"
+)
+
+// Languages with translated card images on ringsdb, besides English.
+var languages = []string{"de", "es", "fr", "it", "pl"}
+
+func isLanguage(lang string) bool {
+	for _, l := range languages {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// imageSources lists where to download card images from, in the order to try
+// them.
+type imageSources struct {
+	Order          []string
+	HallOfBeornURL string
+
+	// SiteURL and ImagePrefix locate images on the game's card database,
+	// the ringsdb source.
+	SiteURL     string
+	ImagePrefix string
+
+	// Lang is the language of ringsdb images, which are then cached under
+	// a directory named for the language; empty means English.
+	Lang string
+}
+
+func parseImageSources(list string) ([]string, error) {
+	var order []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		switch s {
+		case sourceRingsDB, sourceHallOfBeorn:
+			order = append(order, s)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown image source %q", s)
+		}
+	}
+	if len(order) == 0 {
+		return nil, errors.New("no image sources given")
+	}
+	return order, nil
+}
+
+// without returns the sources with one removed.
+func (is imageSources) without(source string) imageSources {
+	order := make([]string, 0, len(is.Order))
+	for _, s := range is.Order {
+		if s != source {
+			order = append(order, s)
+		}
+	}
+	is.Order = order
+	return is
+}
+
+func (is imageSources) has(source string) bool {
+	for _, s := range is.Order {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch downloads a card's image from the first source that has it.
+func (is imageSources) fetch(ctx context.Context, f *fetcher, card XMLCard, timeout time.Duration) ([]byte, error) {
+	err := fmt.Errorf("no image source for %s", card.ImagePath)
+	for _, source := range is.Order {
+		u := is.url(source, card)
+		if u == "" {
+			continue
+		}
+		var data []byte
+		data, err = f.getBytes(ctx, u, timeout)
+		if err == nil {
+			return data, nil
+		}
+		imageLog(card.ImagePath).warn("failed fetching %s from %s: %v", card.ImagePath, source, err)
+
+		if source == sourceRingsDB && is.Lang != "" {
+			english := is.SiteURL + path.Join(is.ImagePrefix, strings.TrimPrefix(card.ImagePath, is.Lang+"/"))
+			data, err = f.getBytes(ctx, english, timeout)
+			if err == nil {
+				imageLog(card.ImagePath).warn("no %s image for %s; using English", is.Lang, card.Name)
+				return data, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+// url returns the address of a card's image at a source, or "" if the
+// source can't provide it.
+func (is imageSources) url(source string, card XMLCard) string {
+	switch source {
+	case sourceRingsDB:
+		if strings.HasPrefix(card.ImagePath, hallOfBeornFolder+"/") {
+			return ""
+		}
+		return is.SiteURL + path.Join(is.ImagePrefix, card.ImagePath)
+	case sourceHallOfBeorn:
+		if card.Name == "" {
+			return ""
+		}
+		return strings.TrimSuffix(is.HallOfBeornURL, "/") + "/" + url.PathEscape(hallOfBeornFileName(card.Name))
+	}
+	return ""
+}
+
+// hallOfBeornFileName is the image file name Hall of Beorn uses for a card,
+// with spaces replaced by dashes.
+func hallOfBeornFileName(name string) string {
+	return strings.Replace(strings.TrimSpace(name), " ", "-", -1) + ".jpg"
+}
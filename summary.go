@@ -0,0 +1,155 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// Layout of --summary pages, in millimeters.
+const (
+	summaryMargin       = 15.0
+	summaryTitleHeight  = 8.0
+	summaryHeaderHeight = summaryTitleHeight + 2*summaryLineHeight // title, date and a gap
+	summaryLineHeight   = 5.0
+	summaryQtyWidth     = 12.0
+	summarySphereWidth  = 35.0
+	summaryTypeWidth    = 30.0
+)
+
+// summaryRow is a line of the --summary deck list: a card, or a heading for
+// a section or the totals with the number of cards under it.
+type summaryRow struct {
+	Heading  bool
+	Quantity int
+	Name     string
+	Sphere   string
+	Type     string
+}
+
+// summaryRows lists a deck's cards by section, in order of each section's
+// first card, with a heading and count for each section and the totals at
+// the end.
+func summaryRows(deck []XMLCard) []summaryRow {
+	var sections []string
+	bySection := make(map[string][]summaryRow)
+	index := make(map[string]int) // of each card's row within its section
+	distinct := make(map[string]bool)
+	total := 0
+	for _, card := range deck {
+		if _, ok := bySection[card.Section]; !ok {
+			sections = append(sections, card.Section)
+			bySection[card.Section] = nil
+		}
+		total += card.Quantity
+		distinct[card.OctgnID] = true
+
+		key := card.Section + "\x00" + card.OctgnID
+		if i, ok := index[key]; ok {
+			bySection[card.Section][i].Quantity += card.Quantity
+			continue
+		}
+		index[key] = len(bySection[card.Section])
+		bySection[card.Section] = append(bySection[card.Section], summaryRow{
+			Quantity: card.Quantity,
+			Name:     card.Name,
+			Sphere:   card.Sphere,
+			Type:     card.Type,
+		})
+	}
+
+	var rows []summaryRow
+	for _, section := range sections {
+		heading := summaryRow{Heading: true, Name: section}
+		if heading.Name == "" {
+			heading.Name = "Cards"
+		}
+		for _, row := range bySection[section] {
+			heading.Quantity += row.Quantity
+		}
+		rows = append(rows, heading)
+		rows = append(rows, bySection[section]...)
+	}
+	return append(rows, summaryRow{
+		Heading:  true,
+		Quantity: total,
+		Name:     fmt.Sprintf("Total (%d different cards)", len(distinct)),
+	})
+}
+
+// summaryRowsPerPage is how many rows fit on a summary page below its
+// header.
+func summaryRowsPerPage(layout Layout) int {
+	n := int((layout.PageHeight - 2*summaryMargin - summaryHeaderHeight) / summaryLineHeight)
+	if n < 2 {
+		n = 2
+	}
+	return n
+}
+
+// paginateSummary splits rows into pages of at most perPage, moving a
+// heading that would end a page to the start of the next.
+func paginateSummary(rows []summaryRow, perPage int) [][]summaryRow {
+	var pages [][]summaryRow
+	for len(rows) > 0 {
+		n := perPage
+		if n >= len(rows) {
+			n = len(rows)
+		} else if rows[n-1].Heading {
+			n--
+		}
+		pages = append(pages, rows[:n])
+		rows = rows[n:]
+	}
+	return pages
+}
+
+// renderSummary adds the pages of a --summary deck list titled with the
+// deck's name and the date.  With blankBacks each is followed by a blank
+// page, so card fronts and backs still share sheets when printed
+// double-sided.
+func renderSummary(pdf *gofpdf.Fpdf, layout Layout, name string, date time.Time, pages [][]summaryRow, blankBacks bool) {
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	fit := func(text string, w float64) string {
+		return tr(fitText(pdf, tr, text, w-2*pdf.GetCellMargin()))
+	}
+	w := layout.PageWidth - 2*summaryMargin
+	nameWidth := w - summaryQtyWidth - summarySphereWidth - summaryTypeWidth
+
+	for i, rows := range pages {
+		pdf.AddPage()
+		pdf.SetTextColor(0, 0, 0)
+		pdf.SetXY(summaryMargin, summaryMargin)
+		pdf.SetFont("Helvetica", "B", 14)
+		pdf.CellFormat(w, summaryTitleHeight, fit(name, w), "", 2, "LM", false, 0, "")
+		pdf.SetFont("Helvetica", "", 9)
+		info := fmt.Sprintf("Deck list generated on %s - page %d of %d", date.Format("2006-01-02"), i+1, len(pages))
+		pdf.CellFormat(w, summaryLineHeight, tr(info), "", 2, "LM", false, 0, "")
+		pdf.Ln(summaryLineHeight)
+
+		for _, row := range rows {
+			style, border := "", ""
+			if row.Heading {
+				style, border = "B", "B"
+			}
+			pdf.SetFont("Helvetica", style, 9)
+			pdf.SetX(summaryMargin)
+			pdf.CellFormat(summaryQtyWidth, summaryLineHeight, strconv.Itoa(row.Quantity), border, 0, "LM", false, 0, "")
+			pdf.CellFormat(nameWidth, summaryLineHeight, fit(row.Name, nameWidth), border, 0, "LM", false, 0, "")
+			pdf.CellFormat(summarySphereWidth, summaryLineHeight, fit(row.Sphere, summarySphereWidth), border, 0, "LM", false, 0, "")
+			pdf.CellFormat(summaryTypeWidth, summaryLineHeight, fit(row.Type, summaryTypeWidth), border, 1, "LM", false, 0, "")
+		}
+
+		if blankBacks {
+			pdf.AddPage()
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// Polling of the input file for --watch.
+const (
+	watchInterval = 500 * time.Millisecond
+	watchSettle   = time.Second // unchanged for this long before it is read again
+)
+
+// fileVersion tells versions of a file apart.
+type fileVersion struct {
+	modified time.Time
+	size     int64
+}
+
+func statFile(name string) (fileVersion, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	return fileVersion{modified: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// Watch writes the output again whenever the input file changes, once it
+// has stopped changing, until the run is interrupted.  Errors are logged
+// and watching goes on, except for failing to load card metadata the first
+// time.  Metadata is loaded again only once it is older than
+// metadataMaxAge.
+func (app *App) Watch() {
+	var appErr *AppError
+	if app.ctx.Err() != nil || errors.As(app.err, &appErr) && appErr.Stage == stageMetadata {
+		return
+	}
+	if app.err != nil {
+		logWarn("%v", app.err)
+		app.err = nil
+	}
+
+	loaded := time.Now()
+	last, _ := statFile(app.inputFile)
+	var changed time.Time // when the file last changed, until it is read
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	logInfo("watching %s for changes; press Ctrl-C to stop", app.inputFile)
+	for {
+		select {
+		case <-app.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// A file being replaced may briefly not exist; wait for it.
+		version, err := statFile(app.inputFile)
+		if err != nil {
+			continue
+		}
+		if version != last {
+			last, changed = version, time.Now()
+			continue
+		}
+		if changed.IsZero() || time.Since(changed) < watchSettle {
+			continue
+		}
+		changed = time.Time{}
+
+		logInfo("%s changed; writing %s again", app.inputFile, app.outputFile)
+		if time.Since(loaded) >= metadataMaxAge {
+			cards := app.octgnToCard
+			timeStage("metadata", app.LoadMetadata)
+			if app.err != nil {
+				logWarn("%v (using the metadata already loaded)", app.err)
+				app.octgnToCard, app.err = cards, nil
+			} else {
+				loaded = time.Now()
+			}
+		}
+		app.deck, app.missing = nil, nil
+		app.runPipeline()
+		if app.ctx.Err() != nil {
+			app.err = nil
+			return
+		}
+		if app.err != nil {
+			logWarn("%v", app.err)
+			app.err = nil
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"math"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// Values of --watermark-position.
+const (
+	watermarkCenter   = "center"
+	watermarkBottom   = "bottom"
+	watermarkDiagonal = "diagonal"
+)
+
+const (
+	defaultWatermarkOpacity = 0.15
+
+	// Size of watermark text before it is shrunk to fit, in points.
+	watermarkFontSize = 28.0
+
+	// Fraction of the card width, or of its diagonal, that watermark text
+	// may take up.
+	watermarkFill = 0.9
+)
+
+// Watermark is text printed across each card, such as "PLAYTEST v3".
+type Watermark struct {
+	Text     string // none if empty
+	Opacity  float64
+	Position string
+}
+
+// watermarkPlacement is where and how large to print watermark text in a
+// card slot: its font size in points, the start of its baseline and its
+// counterclockwise rotation in degrees about that point.
+type watermarkPlacement struct {
+	FontSize float64
+	X, Y     float64
+	Angle    float64
+}
+
+// placeWatermark fits text that is width millimeters wide at fontSize
+// points into slot, shrinking it to fit if it's too long.  ptToMM converts
+// points to millimeters.
+func placeWatermark(slot Rect, position string, width, fontSize, ptToMM float64) watermarkPlacement {
+	room := slot.W
+	if position == watermarkDiagonal {
+		room = math.Hypot(slot.W, slot.H)
+	}
+	room *= watermarkFill
+	if width > room {
+		fontSize *= room / width
+		width = room
+	}
+
+	// Cap height is about 0.7 of the font size for Helvetica.
+	capHeight := 0.7 * fontSize * ptToMM
+	p := watermarkPlacement{FontSize: fontSize}
+	cx, cy := slot.X+slot.W/2, slot.Y+slot.H/2
+	switch position {
+	case watermarkBottom:
+		p.X = cx - width/2
+		p.Y = slot.Y + slot.H*(1+watermarkFill)/2
+	case watermarkDiagonal:
+		// Run from the lower left to the upper right, turning about the
+		// center of the card.
+		p.Angle = math.Atan2(slot.H, slot.W) * 180 / math.Pi
+		fallthrough
+	default:
+		p.X = cx - width/2
+		p.Y = cy + capHeight/2
+	}
+	return p
+}
+
+// renderWatermark prints wm's text translucently over a card slot.
+func renderWatermark(pdf gofpdf.Pdf, tr func(string) string, slot Rect, wm Watermark, fontScale float64) {
+	text := tr(wm.Text)
+	pdf.SetFont("Helvetica", "B", watermarkFontSize*fontScale)
+	p := placeWatermark(slot, wm.Position, pdf.GetStringWidth(text), watermarkFontSize*fontScale, 1/pdf.GetConversionRatio())
+	pdf.SetFontSize(p.FontSize)
+
+	pdf.SetAlpha(wm.Opacity, "Normal")
+	pdf.SetTextColor(0, 0, 0)
+	if p.Angle != 0 {
+		pdf.TransformBegin()
+		pdf.TransformRotate(p.Angle, slot.X+slot.W/2, slot.Y+slot.H/2)
+	}
+	pdf.Text(p.X, p.Y, text)
+	if p.Angle != 0 {
+		pdf.TransformEnd()
+	}
+	pdf.SetAlpha(1.0, "Normal")
+}
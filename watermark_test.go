@@ -0,0 +1,41 @@
+// Copyright 2019 by David A. Golden. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPlaceWatermark(t *testing.T) {
+	// A 60x80 mm slot, centered at (40, 60), with half a millimeter to
+	// the point to keep the numbers simple.  Text may take up 54 mm across
+	// or 90 mm along the diagonal, which is at atan(80/60).
+	slot := Rect{X: 10, Y: 20, W: 60, H: 80}
+	diagonal := math.Atan2(80, 60) * 180 / math.Pi
+	tests := []struct {
+		name     string
+		position string
+		width    float64
+		want     watermarkPlacement
+	}{
+		{"center", watermarkCenter, 30, watermarkPlacement{FontSize: 28, X: 25, Y: 64.9}},
+		{"center, too long", watermarkCenter, 108, watermarkPlacement{FontSize: 14, X: 13, Y: 62.45}},
+		{"bottom", watermarkBottom, 30, watermarkPlacement{FontSize: 28, X: 25, Y: 96}},
+		{"bottom, too long", watermarkBottom, 108, watermarkPlacement{FontSize: 14, X: 13, Y: 96}},
+		{"diagonal", watermarkDiagonal, 30, watermarkPlacement{FontSize: 28, X: 25, Y: 64.9, Angle: diagonal}},
+		{"diagonal, fits only diagonally", watermarkDiagonal, 80, watermarkPlacement{FontSize: 28, X: 0, Y: 64.9, Angle: diagonal}},
+		{"diagonal, too long", watermarkDiagonal, 180, watermarkPlacement{FontSize: 14, X: -5, Y: 62.45, Angle: diagonal}},
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	for _, tt := range tests {
+		got := placeWatermark(slot, tt.position, tt.width, 28, 0.5)
+		if !near(got.FontSize, tt.want.FontSize) || !near(got.X, tt.want.X) || !near(got.Y, tt.want.Y) || !near(got.Angle, tt.want.Angle) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}